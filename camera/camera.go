@@ -3,6 +3,7 @@ package camera
 import (
 	"fmt"
 	"image"
+	"sync"
 	"time"
 
 	"github.com/blackjack/webcam"
@@ -19,8 +20,20 @@ type Camera struct {
 	pictures chan<- image.Image
 
 	config CameraConfig
+	// intervalMtx protects config.PictureInterval which can be changed while the camera is running.
+	intervalMtx sync.Mutex
 
-	loopChan chan struct{}
+	loopChan    chan struct{}
+	loopDone    chan struct{}
+	triggerChan chan struct{}
+
+	frameHandler  func(image.Image)
+	frameInterval func() time.Duration
+
+	// stateMtx protects running and lastFrame, which are read for health checks.
+	stateMtx  sync.Mutex
+	running   bool
+	lastFrame time.Time
 }
 
 type CameraConfig struct {
@@ -37,12 +50,13 @@ type CameraConfig struct {
 func NewCamera(cfg CameraConfig) (*Camera, error) {
 	cam, err := webcam.Open(cfg.Device)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error opening %s: %w", cfg.Device, err)
 	}
 
 	c := &Camera{
-		webcam: cam,
-		config: cfg,
+		webcam:      cam,
+		config:      cfg,
+		triggerChan: make(chan struct{}, 1),
 	}
 
 	_, _, _, err = c.webcam.SetImageFormat(webcam.PixelFormat(c.config.Format), c.config.FrameWidth, c.config.FrameHeight)
@@ -58,37 +72,135 @@ func NewCamera(cfg CameraConfig) (*Camera, error) {
 	return c, nil
 }
 
+// Start starts streaming and taking pictures. If streaming can't be started the camera is left stopped.
 func (c *Camera) Start() (<-chan image.Image, error) {
+	if err := c.webcam.StartStreaming(); err != nil {
+		return nil, err
+	}
+
 	pictures := make(chan image.Image)
 	c.pictures = pictures
 
 	c.loopChan = make(chan struct{})
+	c.loopDone = make(chan struct{})
+
+	// Drop any trigger from before the camera was started.
+	select {
+	case <-c.triggerChan:
+	default:
+	}
 
 	go c.loop()
 
-	return pictures, c.webcam.StartStreaming()
+	c.stateMtx.Lock()
+	c.running = true
+	// Give the camera until its first frame before it counts as stuck.
+	c.lastFrame = time.Now()
+	c.stateMtx.Unlock()
+
+	return pictures, nil
 }
 
 func (c *Camera) Stop() error {
+	// Wait for the loop to exit before closing pictures, it could be sending a picture.
 	close(c.loopChan)
+	<-c.loopDone
 	close(c.pictures)
 
+	c.stateMtx.Lock()
+	c.running = false
+	c.stateMtx.Unlock()
+
 	return c.webcam.StopStreaming()
 }
 
+// SetPictureInterval changes the interval at which pictures are taken. It takes effect immediately, even
+// if the camera is already started. An interval of 0 means pictures are only taken when triggered.
+func (c *Camera) SetPictureInterval(interval time.Duration) {
+	c.intervalMtx.Lock()
+	defer c.intervalMtx.Unlock()
+
+	c.config.PictureInterval = interval
+}
+
+func (c *Camera) pictureInterval() time.Duration {
+	c.intervalMtx.Lock()
+	defer c.intervalMtx.Unlock()
+
+	return c.config.PictureInterval
+}
+
+// Trigger takes a picture from the next frame, independent of the picture interval.
+func (c *Camera) Trigger() {
+	select {
+	case c.triggerChan <- struct{}{}:
+	default:
+	}
+}
+
+// SetFrameHandler sets a function that is called with the frames read while the camera is started, not
+// just the pictures taken at the picture interval. Frames are only converted for handler at most every
+// interval, which is checked on every frame, and 0 means every frame. It must be called before Start, and
+// handler must not block.
+func (c *Camera) SetFrameHandler(handler func(image.Image), interval func() time.Duration) {
+	c.frameHandler = handler
+	c.frameInterval = interval
+}
+
+// Running returns true between Start and Stop.
+func (c *Camera) Running() bool {
+	c.stateMtx.Lock()
+	defer c.stateMtx.Unlock()
+
+	return c.running
+}
+
+// LastFrame returns when the last frame was read from the camera, including the frames that weren't
+// pictures.
+func (c *Camera) LastFrame() time.Time {
+	c.stateMtx.Lock()
+	defer c.stateMtx.Unlock()
+
+	return c.lastFrame
+}
+
 func (c *Camera) Close() error {
 	return c.webcam.Close()
 }
 
 func (c *Camera) loop() {
-	ticker := time.NewTicker(c.config.PictureInterval)
-	defer ticker.Stop()
+	var (
+		interval time.Duration
+		ticker   *time.Ticker
+		tick     <-chan time.Time
+	)
+	setInterval := func(i time.Duration) {
+		if ticker != nil {
+			ticker.Stop()
+		}
+
+		interval, ticker, tick = i, nil, nil
+		if interval > 0 {
+			ticker = time.NewTicker(interval)
+			tick = ticker.C
+		}
+	}
+	defer close(c.loopDone)
+
+	setInterval(c.pictureInterval())
+	defer setInterval(0)
+
+	var lastHandled time.Time
 
 	for {
 		select {
 		case <-c.loopChan:
 			return
 		default:
+			if i := c.pictureInterval(); i != interval {
+				setInterval(i)
+			}
+
 			err := c.webcam.WaitForFrame(5)
 			if err != nil {
 				continue
@@ -99,13 +211,38 @@ func (c *Camera) loop() {
 				continue
 			}
 
+			now := time.Now()
+			c.stateMtx.Lock()
+			c.lastFrame = now
+			c.stateMtx.Unlock()
+
+			takePicture := false
 			select {
-			case <-ticker.C:
-				img := encodeFrame(frame, c.config.FrameWidth, c.config.FrameHeight)
-				c.pictures <- img
+			case <-tick:
+				takePicture = true
+			case <-c.triggerChan:
+				takePicture = true
 			default:
+			}
+			handle := c.frameHandler != nil && now.Sub(lastHandled) >= c.frameInterval()
+			if !takePicture && !handle {
 				continue
 			}
+
+			img := encodeFrame(frame, c.config.FrameWidth, c.config.FrameHeight)
+			if handle {
+				c.frameHandler(img)
+				lastHandled = now
+			}
+			if !takePicture {
+				continue
+			}
+
+			select {
+			case c.pictures <- img:
+			case <-c.loopChan:
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,464 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gouthamve/prusaLGTM/camera"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	promAlertmanagerDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prusalgtm",
+			Name:      "alertmanager_request_duration_seconds",
+			Help:      "A histogram of request latencies to Alertmanager.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"code", "method", "printer"},
+	)
+	promAlertmanagerPosts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "alertmanager_posts_total",
+			Help:      "The number of times the alerts were posted to Alertmanager, by result.",
+		},
+		[]string{"result", "printer"},
+	)
+	promAlertsFiring = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "alerts_firing",
+			Help:      "The number of alerts firing, by alert name.",
+		},
+		[]string{"alertname", "printer"},
+	)
+)
+
+const (
+	alertPrintFailure = "PrintFailureDetected"
+	alertPrintWarning = "PrintFailureWarning"
+	alertCameraDark   = "PrintCameraDark"
+
+	// alertDarkInterval is how often the frames of a camera are checked for being dark.
+	alertDarkInterval = 10 * time.Second
+)
+
+type AlertmanagerConfig struct {
+	URLs         []string          `kong:"help='The URL of Alertmanager to post alerts to. Repeat it for every Alertmanager of a cluster.',optional,sep='none',name='alertmanager-url'"`
+	Username     string            `kong:"help='The username for basic auth to Alertmanager.',optional,name='alertmanager-username'"`
+	Password     string            `kong:"help='The password for basic auth to Alertmanager.',optional,name='alertmanager-password',env='PRUSALGTM_ALERTMANAGER_PASSWORD'"`
+	PasswordFile string            `kong:"help='A file with the password for basic auth to Alertmanager.',optional,name='alertmanager-password-file',type='path'"`
+	Labels       map[string]string `kong:"help='Extra labels to add to every alert, eg. severity=critical;team=lab.',optional,name='alertmanager-labels'"`
+	// Alertmanager can't link to the snapshot without knowing where we are.
+	ExternalURL string `kong:"help='The URL prusaLGTM is reachable at, for the snapshot links in the alerts. The links need --stream.',optional,name='alertmanager-external-url'"`
+
+	ResendInterval    time.Duration `kong:"help='The interval at which firing alerts are sent again. Alerts that are not sent again resolve after 4 intervals.',default='1m',name='alertmanager-resend-interval'"`
+	MinConfidence     float64       `kong:"help='Minimum confidence of a detection for it to count towards a failure alert.',default='0.6',name='alertmanager-min-confidence'"`
+	ConsecutiveFrames int           `kong:"help='Fire the failure alert after this many consecutive frames with a failure.',default='3',name='alertmanager-consecutive-frames'"`
+	DarkThreshold     float64       `kong:"help='Fire the camera alert when the average brightness of a frame is below this, between 0 and 1. 0 disables it.',default='0.05',name='alertmanager-dark-threshold'"`
+}
+
+// alertmanagerAlert is an alert as posted to /api/v2/alerts.
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// alerter posts an alert to Alertmanager while a failure is confirmed on a camera, and while a running
+// camera is dark or stopped sending frames. Firing alerts are sent again every resend interval, and
+// resolved alerts are sent once with their end time.
+type alerter struct {
+	cfg      AlertmanagerConfig
+	client   *http.Client
+	username string
+	password string
+	// snapshotURLs has the snapshot link of every camera, empty without one.
+	snapshotURLs map[string]string
+	cameras      map[string]*camera.Camera
+	staleAfter   time.Duration
+	log          logger
+
+	// wake makes run post the alerts right away.
+	wake chan struct{}
+
+	mtx      sync.Mutex
+	job      string
+	streaks  map[string]*failureStreak
+	firing   map[string]alertmanagerAlert
+	resolved []alertmanagerAlert
+	lastPost time.Time
+	lastErr  error
+}
+
+// newAlerter returns nil if no Alertmanager is configured. cameras and snapshotURLs are by camera name.
+func newAlerter(cfg AlertmanagerConfig, cameras map[string]*camera.Camera, snapshotURLs map[string]string, staleAfter time.Duration, log logger) (*alerter, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, nil
+	}
+
+	for _, u := range cfg.URLs {
+		if _, err := url.Parse(u); err != nil {
+			return nil, fmt.Errorf("invalid --alertmanager-url: %w", err)
+		}
+	}
+
+	password, err := readSecret(cfg.Password, cfg.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	durations := promAlertmanagerDuration.MustCurryWith(prometheus.Labels{"printer": log.printer})
+
+	return &alerter{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: promhttp.InstrumentRoundTripperDuration(durations, http.DefaultTransport),
+		},
+		username:     cfg.Username,
+		password:     password,
+		snapshotURLs: snapshotURLs,
+		cameras:      cameras,
+		staleAfter:   staleAfter,
+		log:          log,
+		wake:         make(chan struct{}, 1),
+		streaks:      map[string]*failureStreak{},
+		firing:       map[string]alertmanagerAlert{},
+	}, nil
+}
+
+// observe fires the failure alert of the camera once a failure is confirmed or the failure score is
+// critical, and resolves it on the first frame without a failure and with a lower score. The warning alert
+// fires while the failure score is at least a warning.
+func (a *alerter) observe(_ context.Context, d detection) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	if d.level >= levelWarning {
+		a.fire(alertPrintWarning, d.camera,
+			"A print failure may be starting",
+			fmt.Sprintf("The failure score of the job is %.2f.", d.score),
+		)
+	} else {
+		a.resolve(alertPrintWarning, d.camera)
+	}
+
+	streak, ok := a.streaks[d.camera]
+	if !ok {
+		streak = &failureStreak{}
+		a.streaks[d.camera] = streak
+	}
+
+	confirmed := streak.observe(d.failures, a.cfg.MinConfidence, a.cfg.ConsecutiveFrames, 0, time.Now())
+	if !confirmed && d.level != levelCritical && !d.firstLayerFailed {
+		if streak.frames == 0 {
+			a.resolve(alertPrintFailure, d.camera)
+		}
+		return
+	}
+
+	confidence := 0.0
+	for _, failure := range d.failures {
+		confidence = max(confidence, failure.Confidence)
+	}
+	description := fmt.Sprintf("A failure was detected with %.0f%% confidence in %d consecutive frames.", confidence*100, streak.frames)
+	switch {
+	case d.firstLayerFailed:
+		description = "The first layer failed the inspection."
+	case !confirmed:
+		description = fmt.Sprintf("The failure score of the job is critical at %.2f.", d.score)
+	}
+	a.fire(alertPrintFailure, d.camera, "A print failure was detected", description)
+}
+
+// frameHandler returns the frame handler of the camera. A dark frame fires the camera alert, any other
+// frame resolves it.
+func (a *alerter) frameHandler(camera string) frameHandler {
+	return frameHandler{interval: everyInterval(alertDarkInterval), handle: func(img image.Image) {
+		dark := a.cfg.DarkThreshold > 0 && brightness(img) < a.cfg.DarkThreshold
+
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+
+		if dark {
+			a.fire(alertCameraDark, camera, "The camera is dark", "The frames from the camera are too dark to see the print.")
+		} else {
+			a.resolve(alertCameraDark, camera)
+		}
+	}}
+}
+
+// brightness returns the average luminance of the frame between 0 and 1, from a grid of samples.
+func brightness(img image.Image) float64 {
+	const samples = 32
+
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return 0
+	}
+
+	total := 0.0
+	for y := 0; y < samples; y++ {
+		for x := 0; x < samples; x++ {
+			px := img.At(bounds.Min.X+x*bounds.Dx()/samples, bounds.Min.Y+y*bounds.Dy()/samples)
+			total += float64(color.GrayModel.Convert(px).(color.Gray).Y) / 255
+		}
+	}
+
+	return total / (samples * samples)
+}
+
+// watch keeps the job label up to date and resolves the failure alerts when the job ends, until events is
+// closed.
+func (a *alerter) watch(events <-chan printerEvent) {
+	for event := range events {
+		a.mtx.Lock()
+		if !event.To.isJobActive() {
+			for camera := range a.streaks {
+				a.resolve(alertPrintFailure, camera)
+				a.resolve(alertPrintWarning, camera)
+			}
+		}
+		a.job = ""
+		if event.To.isJobActive() && event.Status != nil {
+			a.job = event.Status.JobName
+		}
+		a.mtx.Unlock()
+	}
+}
+
+func alertKey(name, camera string) string {
+	return name + "/" + camera
+}
+
+// fire must be called with mtx held.
+func (a *alerter) fire(name, camera, summary, description string) {
+	// The alerts are encoded without holding mtx, so a firing alert isn't changed.
+	key := alertKey(name, camera)
+	if _, ok := a.firing[key]; ok {
+		return
+	}
+
+	labels := map[string]string{}
+	for k, v := range a.cfg.Labels {
+		labels[k] = v
+	}
+	labels["alertname"] = name
+	if a.log.printer != "" {
+		labels["printer"] = a.log.printer
+	}
+	if camera != "" {
+		labels["camera"] = camera
+	}
+	if a.job != "" {
+		labels["job"] = a.job
+	}
+
+	annotations := map[string]string{
+		"summary":     summary,
+		"description": description,
+	}
+	if snapshot := a.snapshotURLs[camera]; snapshot != "" {
+		annotations["snapshot_url"] = snapshot
+		if name == alertPrintFailure || name == alertPrintWarning {
+			annotations["snapshot_url"] += "?overlays=true"
+		}
+	}
+
+	a.log.Printf("alert %s firing: %s\n", name, description)
+	a.firing[key] = alertmanagerAlert{
+		Labels:       labels,
+		Annotations:  annotations,
+		StartsAt:     time.Now(),
+		GeneratorURL: a.cfg.ExternalURL,
+	}
+	a.wakeUp()
+}
+
+// resolve must be called with mtx held.
+func (a *alerter) resolve(name, camera string) {
+	key := alertKey(name, camera)
+	alert, ok := a.firing[key]
+	if !ok {
+		return
+	}
+
+	a.log.Printf("alert %s resolved\n", name)
+	delete(a.firing, key)
+	alert.EndsAt = time.Now()
+	a.resolved = append(a.resolved, alert)
+	a.wakeUp()
+}
+
+func (a *alerter) wakeUp() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// checkCameras fires the camera alert of the running cameras that stopped sending frames, and resolves it
+// for the cameras that stopped with the job.
+func (a *alerter) checkCameras() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for name, cam := range a.cameras {
+		if !cam.Running() {
+			a.resolve(alertCameraDark, name)
+			continue
+		}
+
+		if since := time.Since(cam.LastFrame()); since > a.staleAfter {
+			a.fire(alertCameraDark, name, "The camera is dark", fmt.Sprintf("No frame from the camera for %s.", since.Round(time.Second)))
+		}
+	}
+}
+
+// run posts the alerts when they change and every resend interval, until ctx is done.
+func (a *alerter) run(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.ResendInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.checkCameras()
+		case <-a.wake:
+		}
+
+		a.post(ctx)
+	}
+}
+
+func (a *alerter) post(ctx context.Context) {
+	a.mtx.Lock()
+	alerts := make([]alertmanagerAlert, 0, len(a.firing)+len(a.resolved))
+	// Prometheus uses 4 resend intervals too, so a missed post doesn't resolve the alert.
+	endsAt := time.Now().Add(4 * a.cfg.ResendInterval)
+	firing := map[string]float64{alertPrintFailure: 0, alertPrintWarning: 0, alertCameraDark: 0}
+	for _, alert := range a.firing {
+		alert.EndsAt = endsAt
+		alerts = append(alerts, alert)
+		firing[alert.Labels["alertname"]]++
+	}
+	alerts = append(alerts, a.resolved...)
+	resolved := len(a.resolved)
+	a.mtx.Unlock()
+
+	for name, count := range firing {
+		promAlertsFiring.WithLabelValues(name, a.log.printer).Set(count)
+	}
+	if len(alerts) == 0 {
+		return
+	}
+
+	sort.Slice(alerts, func(i, j int) bool { return alerts[i].StartsAt.Before(alerts[j].StartsAt) })
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		a.log.Println("failed to encode alerts:", err)
+		return
+	}
+
+	// Alertmanager clusters dedup the alerts, so they are sent to every instance.
+	var (
+		postErr error
+		sent    bool
+	)
+	for _, u := range a.cfg.URLs {
+		if err := a.postTo(ctx, u, body); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.log.Printf("failed to post alerts to %s: %v\n", u, err)
+			promAlertmanagerPosts.WithLabelValues("failed", a.log.printer).Inc()
+			postErr = err
+			continue
+		}
+		promAlertmanagerPosts.WithLabelValues("sent", a.log.printer).Inc()
+		sent = true
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.lastPost = time.Now()
+	a.lastErr = postErr
+	// The resolved alerts are sent again until an Alertmanager got them. Alerts resolved while posting are
+	// after them.
+	if sent {
+		a.resolved = a.resolved[resolved:]
+	}
+}
+
+func (a *alerter) postTo(ctx context.Context, alertmanagerURL string, body []byte) error {
+	u, err := url.JoinPath(alertmanagerURL, "/api/v2/alerts")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.username != "" {
+		req.SetBasicAuth(a.username, a.password)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+func (a *alerter) healthCheck() healthCheck {
+	return func() componentHealth {
+		a.mtx.Lock()
+		defer a.mtx.Unlock()
+
+		health := componentHealth{
+			Component: "alertmanager",
+			Printer:   a.log.printer,
+			Healthy:   true,
+			Ready:     a.lastErr == nil,
+			Details:   map[string]any{"firing": len(a.firing)},
+		}
+		if !a.lastPost.IsZero() {
+			health.Details["last_post"] = a.lastPost
+		}
+		if a.lastErr != nil {
+			health.Message = "the last post to Alertmanager failed"
+			health.Details["last_error"] = a.lastErr.Error()
+		}
+
+		return health
+	}
+}
@@ -0,0 +1,190 @@
+package cli
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promAutoPauseTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "auto_pause_total",
+			Help:      "The number of times a confirmed failure triggered a pause, by result.",
+		},
+		[]string{"result", "printer"},
+	)
+	promAutoPauseLastTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "auto_pause_last_timestamp_seconds",
+			Help:      "The timestamp of the last time a confirmed failure triggered a pause.",
+		},
+		[]string{"printer"},
+	)
+	promAutoPauseFailureStreak = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "auto_pause_failure_streak_frames",
+			Help:      "The number of consecutive frames with a failure above the auto-pause confidence threshold.",
+		},
+		[]string{"printer"},
+	)
+)
+
+type AutoPauseConfig struct {
+	Enabled           bool          `kong:"help='Pause the print job when failures are confirmed. Requires a printer URL and --ml-api-url or --detector=heuristic.',default='false',name='auto-pause'"`
+	MinConfidence     float64       `kong:"help='Minimum confidence of a detection for it to count towards pausing.',default='0.6',name='auto-pause-min-confidence'"`
+	ConsecutiveFrames int           `kong:"help='Pause after this many consecutive frames with a failure.',default='3',name='auto-pause-consecutive-frames'"`
+	Window            time.Duration `kong:"help='Also pause when failures have been seen in every frame for this long. 0 disables it.',default='0s',name='auto-pause-window'"`
+	Cooldown          time.Duration `kong:"help='Do not pause again for this long after a pause, so a resumed job keeps printing.',default='30m',name='auto-pause-cooldown'"`
+	DryRun            bool          `kong:"help='Only log that the job would have been paused.',default='false',name='auto-pause-dry-run'"`
+}
+
+// autoPauser confirms failures over several frames and pauses the job on the printer once they are confirmed.
+type autoPauser struct {
+	live    *liveConfig
+	printer printerBackend
+	// firstLayerPause pauses when the first layer fails, even with auto-pause disabled.
+	firstLayerPause bool
+	log             logger
+
+	// The cameras of a printer share the pauser.
+	mtx       sync.Mutex
+	streak    failureStreak
+	lastPause time.Time
+}
+
+func newAutoPauser(live *liveConfig, printer printerBackend, firstLayerPause bool, log logger) *autoPauser {
+	return &autoPauser{
+		live:            live,
+		printer:         printer,
+		firstLayerPause: firstLayerPause,
+		log:             log,
+	}
+}
+
+// observe records the failures detected in a frame and pauses the job if the failure is confirmed.
+func (a *autoPauser) observe(ctx context.Context, d detection) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	now := time.Now()
+	cfg := a.live.get().AutoPause
+	firstLayerFailed := d.firstLayerFailed && (cfg.Enabled || a.firstLayerPause)
+	if !cfg.Enabled && !firstLayerFailed {
+		return
+	}
+
+	confirmed := false
+	if cfg.Enabled {
+		confirmed = a.streak.observe(d.failures, cfg.MinConfidence, cfg.ConsecutiveFrames, cfg.Window, now)
+		promAutoPauseFailureStreak.WithLabelValues(a.log.printer).Set(float64(a.streak.frames))
+		// A failure score that reaches critical confirms the failure too, even if the detections came and went.
+		if d.becameCritical() {
+			a.log.Printf("auto-pause: failure score %.2f is critical\n", d.score)
+			confirmed = true
+		}
+	}
+	if firstLayerFailed {
+		a.log.Println("auto-pause: the first layer failed the inspection")
+		confirmed = true
+	}
+	if !confirmed {
+		return
+	}
+
+	if !a.lastPause.IsZero() && now.Sub(a.lastPause) < cfg.Cooldown {
+		a.log.Printf("auto-pause: failure confirmed after %d frames, but still in cooldown until %s\n", a.streak.frames, a.lastPause.Add(cfg.Cooldown).Format(time.RFC3339))
+		promAutoPauseTotal.WithLabelValues("cooldown", a.log.printer).Inc()
+		return
+	}
+
+	paused, err := a.pause(ctx, cfg.DryRun)
+	if err != nil {
+		a.log.Println("auto-pause: failed to pause job:", err)
+		promAutoPauseTotal.WithLabelValues("failed", a.log.printer).Inc()
+		return
+	}
+
+	a.streak.reset()
+	promAutoPauseFailureStreak.WithLabelValues(a.log.printer).Set(0)
+
+	if paused {
+		a.lastPause = now
+		promAutoPauseLastTimestamp.WithLabelValues(a.log.printer).SetToCurrentTime()
+	}
+}
+
+// pause pauses the current job. It returns false if there was no job to pause.
+func (a *autoPauser) pause(ctx context.Context, dryRun bool) (bool, error) {
+	status, err := a.printer.status(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if status.State != statePrinting {
+		a.log.Printf("auto-pause: failure confirmed, but printer is %s. Not pausing.\n", status.State)
+		promAutoPauseTotal.WithLabelValues("not_printing", a.log.printer).Inc()
+		return false, nil
+	}
+
+	if dryRun {
+		a.log.Printf("auto-pause: failure confirmed after %d frames, would pause job %q (dry-run)\n", a.streak.frames, status.JobName)
+		promAutoPauseTotal.WithLabelValues("dry_run", a.log.printer).Inc()
+		return true, nil
+	}
+
+	if err := a.printer.pauseJob(ctx, status.JobID); err != nil {
+		return false, err
+	}
+
+	a.log.Printf("auto-pause: failure confirmed after %d frames, paused job %q\n", a.streak.frames, status.JobName)
+	promAutoPauseTotal.WithLabelValues("paused", a.log.printer).Inc()
+	return true, nil
+}
+
+// failureStreak confirms a failure once it has been seen in enough consecutive frames, or in every frame
+// for long enough.
+type failureStreak struct {
+	frames int
+	start  time.Time
+}
+
+// observe records the failures detected in a frame and returns true if the failure is confirmed. A window
+// of 0 only confirms by the number of frames.
+func (s *failureStreak) observe(failures []detectedFailure, minConfidence float64, consecutiveFrames int, window time.Duration, now time.Time) bool {
+	if !hasConfidentFailure(failures, minConfidence) {
+		s.reset()
+		return false
+	}
+
+	if s.frames == 0 {
+		s.start = now
+	}
+	s.frames++
+
+	if s.frames >= consecutiveFrames {
+		return true
+	}
+	return window > 0 && now.Sub(s.start) >= window
+}
+
+func (s *failureStreak) reset() {
+	s.frames = 0
+	s.start = time.Time{}
+}
+
+func hasConfidentFailure(failures []detectedFailure, minConfidence float64) bool {
+	for _, failure := range failures {
+		if failure.Confidence >= minConfidence {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CapturePolicyConfig struct {
+	FirstLayerHeight float64       `kong:"help='The Z height in mm up to which the job is printing its first layer. The first-layer capture settings are used, and the first layer is inspected, up to it. --first-layer-height is a deprecated alias.',default='0.4',name='capture-first-layer-height',aliases='first-layer-height'"`
+	FirstLayer       captureRule   `kong:"help='Capture settings while printing the first layer, as a comma separated list of interval, size, detect and layer.',default='interval=5s,detect=true',name='capture-first-layer'"`
+	Printing         captureRule   `kong:"help='Capture settings while printing after the first layer.',default='detect=true',name='capture-printing'"`
+	Paused           captureRule   `kong:"help='Capture settings while the job is paused or needs attention.',default='interval=1m',name='capture-paused'"`
+	Finished         captureRule   `kong:"help='Capture settings for the burst of frames after a job finishes.',default='interval=5s',name='capture-finished'"`
+	FinishedDuration time.Duration `kong:"help='How long to keep capturing after a job finishes. 0 disables it.',default='5m',name='capture-finished-duration'"`
+
+	// Used by rules with layer=true.
+	LayerMinStep float64       `kong:"help='The minimum Z increase in mm that counts as a layer change.',default='0.05',name='capture-layer-min-step'"`
+	LayerDelay   time.Duration `kong:"help='How long to wait after a layer change before taking the frame.',default='0s',name='capture-layer-delay'"`
+}
+
+// ruleFor returns the capture settings for the printer state, and false if no frames should be captured.
+func (c CapturePolicyConfig) ruleFor(state printerState, status *printerStatus, finishedAt time.Time) (captureRule, bool) {
+	switch state {
+	case statePrinting:
+		if c.inFirstLayer(status) {
+			return c.FirstLayer, true
+		}
+		return c.Printing, true
+	case statePaused, stateAttention:
+		return c.Paused, true
+	case stateFinished:
+		if !finishedAt.IsZero() && time.Since(finishedAt) < c.FinishedDuration {
+			return c.Finished, true
+		}
+	}
+
+	return captureRule{}, false
+}
+
+// inFirstLayer returns true if the Z height of the status is in the first layer.
+func (c CapturePolicyConfig) inFirstLayer(status *printerStatus) bool {
+	return status != nil && status.HasAxisZ && status.AxisZ <= c.FirstLayerHeight
+}
+
+// captureRule is parsed from a comma separated list of settings, eg. "interval=5s,size=720,detect=true".
+// An interval or size that isn't set falls back to --camera-picture-interval and --max-image-size. With
+// layer=true a frame is taken on every layer change instead of every interval.
+type captureRule struct {
+	Interval     time.Duration
+	MaxImageSize ImageSize
+	Detect       bool
+	Layer        bool
+}
+
+func (r *captureRule) UnmarshalText(text []byte) error {
+	*r = captureRule{}
+	if len(text) == 0 {
+		return nil
+	}
+
+	for _, setting := range strings.Split(string(text), ",") {
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return fmt.Errorf("invalid capture setting %q, expected key=value", setting)
+		}
+
+		switch strings.TrimSpace(key) {
+		case "interval":
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("invalid capture interval %q: %w", value, err)
+			}
+			r.Interval = interval
+		case "size":
+			size, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid capture size %q: %w", value, err)
+			}
+			if !isValidImageSize(ImageSize(size)) {
+				return fmt.Errorf("invalid capture size %d, expected one of 1080, 720, 480, 360, 240", size)
+			}
+			r.MaxImageSize = ImageSize(size)
+		case "detect":
+			detect, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid capture detect %q: %w", value, err)
+			}
+			r.Detect = detect
+		case "layer":
+			layer, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("invalid capture layer %q: %w", value, err)
+			}
+			r.Layer = layer
+		default:
+			return fmt.Errorf("unknown capture setting %q", key)
+		}
+	}
+
+	return nil
+}
+
+func (r captureRule) String() string {
+	if r.Layer {
+		return fmt.Sprintf("layer=true,size=%d,detect=%t", r.MaxImageSize, r.Detect)
+	}
+	return fmt.Sprintf("interval=%s,size=%d,detect=%t", r.Interval, r.MaxImageSize, r.Detect)
+}
+
+// pictureInterval is the camera picture interval for the rule. Frames are triggered on layer changes
+// instead of a timer for layer rules.
+func (r captureRule) pictureInterval() time.Duration {
+	if r.Layer {
+		return 0
+	}
+	return r.Interval
+}
+
+func (r captureRule) withDefaults(interval time.Duration, maxImageSize ImageSize) captureRule {
+	if r.Interval == 0 {
+		r.Interval = interval
+	}
+	if r.MaxImageSize == 0 {
+		r.MaxImageSize = maxImageSize
+	}
+
+	return r
+}
+
+// activeCaptureRule is the capture rule in effect. It is set by whatever controls the camera and read for
+// every frame that is logged.
+type activeCaptureRule struct {
+	mtx  sync.Mutex
+	rule captureRule
+}
+
+func newActiveCaptureRule(rule captureRule) *activeCaptureRule {
+	return &activeCaptureRule{rule: rule}
+}
+
+func (a *activeCaptureRule) get() captureRule {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	return a.rule
+}
+
+func (a *activeCaptureRule) set(rule captureRule) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.rule = rule
+}
+
+// layerChangeDetector detects layer changes from the polled Z height. The Z height has to be seen in two
+// consecutive checks so that a Z hop during a travel move isn't counted as a layer.
+type layerChangeDetector struct {
+	lastLayerZ float64
+	previousZ  float64
+}
+
+func newLayerChangeDetector() *layerChangeDetector {
+	return &layerChangeDetector{
+		lastLayerZ: -1,
+		previousZ:  -1,
+	}
+}
+
+// observe returns true if z is the height of a new layer, at least minStep above the last one.
+func (l *layerChangeDetector) observe(z, minStep float64) bool {
+	stable := z == l.previousZ
+	l.previousZ = z
+
+	if !stable || z < l.lastLayerZ+minStep {
+		return false
+	}
+
+	l.lastLayerZ = z
+	return true
+}
+
+func (l *layerChangeDetector) reset() {
+	l.lastLayerZ = -1
+	l.previousZ = -1
+}
@@ -0,0 +1,406 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kong"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is a YAML file with the values of the flags, keyed by the flag name. Nested maps are joined
+// with "-", so these are the same:
+//
+//	camera-device: /dev/video1
+//	camera:
+//	  device: /dev/video1
+//
+// The values under "printers" are per-printer sections that override the top-level values for the printer
+// selected with --printer. A printer section can have a "cameras" section with the camera settings of each
+// of its cameras, when it has more than one. Flags set on the command line override the file.
+type configFile struct {
+	values   map[string]any
+	printers map[string]map[string]any
+	// cameras are the camera sections, by printer and then camera name.
+	cameras map[string]map[string]map[string]any
+}
+
+func parseConfigFile(r io.Reader) (*configFile, error) {
+	raw := map[string]any{}
+	if err := yaml.NewDecoder(r).Decode(&raw); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	cfg := &configFile{
+		values:   map[string]any{},
+		printers: map[string]map[string]any{},
+		cameras:  map[string]map[string]map[string]any{},
+	}
+
+	printers, ok := raw["printers"]
+	delete(raw, "printers")
+	if ok {
+		printersMap, ok := printers.(map[any]any)
+		if !ok {
+			return nil, fmt.Errorf("expected printers to be a map of printer names to settings, got %T", printers)
+		}
+
+		for name, section := range printersMap {
+			sectionMap, ok := section.(map[any]any)
+			if !ok {
+				return nil, fmt.Errorf("expected the settings for printer %v to be a map, got %T", name, section)
+			}
+
+			cameras, err := parseCameraSections(sectionMap)
+			if err != nil {
+				return nil, fmt.Errorf("printer %v: %w", name, err)
+			}
+
+			values := map[string]any{}
+			if err := flattenConfig("", sectionMap, values); err != nil {
+				return nil, fmt.Errorf("printer %v: %w", name, err)
+			}
+			cfg.printers[fmt.Sprint(name)] = values
+			if len(cameras) > 0 {
+				cfg.cameras[fmt.Sprint(name)] = cameras
+			}
+		}
+	}
+
+	topLevel := make(map[any]any, len(raw))
+	for k, v := range raw {
+		topLevel[k] = v
+	}
+	if err := flattenConfig("", topLevel, cfg.values); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// parseCameraSections removes the "cameras" section from the printer section and returns the flattened
+// values of each camera.
+func parseCameraSections(section map[any]any) (map[string]map[string]any, error) {
+	cameras, ok := section["cameras"]
+	delete(section, "cameras")
+	if !ok {
+		return nil, nil
+	}
+
+	camerasMap, ok := cameras.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("expected cameras to be a map of camera names to settings, got %T", cameras)
+	}
+
+	out := map[string]map[string]any{}
+	for name, cameraSection := range camerasMap {
+		cameraMap, ok := cameraSection.(map[any]any)
+		if !ok {
+			return nil, fmt.Errorf("expected the settings for camera %v to be a map, got %T", name, cameraSection)
+		}
+
+		values := map[string]any{}
+		if err := flattenConfig("", cameraMap, values); err != nil {
+			return nil, fmt.Errorf("camera %v: %w", name, err)
+		}
+		out[fmt.Sprint(name)] = values
+	}
+
+	return out, nil
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+	f, err := os.Open(kong.ExpandPath(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseConfigFile(f)
+}
+
+func flattenConfig(prefix string, in map[any]any, out map[string]any) error {
+	for k, v := range in {
+		key, ok := k.(string)
+		if !ok {
+			return fmt.Errorf("expected setting names to be strings, got %v", k)
+		}
+		key = prefix + strings.ReplaceAll(key, "_", "-")
+
+		switch v := v.(type) {
+		case map[any]any:
+			if err := flattenConfig(key+"-", v, out); err != nil {
+				return err
+			}
+		case []any:
+			// Lists are joined with the separator of the flag when they are resolved.
+			values := make([]string, 0, len(v))
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+			out[key] = values
+		case nil:
+		default:
+			out[key] = v
+		}
+	}
+
+	return nil
+}
+
+// printerNames returns the names of the printer sections, sorted.
+func (c *configFile) printerNames() []string {
+	names := make([]string, 0, len(c.printers))
+	for name := range c.printers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// selectPrinter returns the printer section to use for the --printer flag. There's no need to pick the
+// printer when there is only one, and without printer sections it returns an empty name.
+func (c *configFile) selectPrinter(printer string) (string, error) {
+	if printer == "" {
+		if len(c.printers) == 1 {
+			return c.printerNames()[0], nil
+		}
+		return "", nil
+	}
+
+	if _, ok := c.printers[printer]; !ok {
+		return "", fmt.Errorf("printer %q not found in the config file. Available printers: %s", printer, strings.Join(c.printerNames(), ", "))
+	}
+
+	return printer, nil
+}
+
+// printerCameras returns the cameras of the printer, with the camera sections applied on top of the
+// printer section. A printer without camera sections has the single camera fallback.
+func (c *configFile) printerCameras(printer string, fallback namedCamera) ([]namedCamera, error) {
+	sections := c.cameras[printer]
+	if len(sections) == 0 {
+		return []namedCamera{fallback}, nil
+	}
+
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	cameras := make([]namedCamera, 0, len(names))
+	for _, name := range names {
+		p, err := c.parsePrintImage(printer, name)
+		if err != nil {
+			return nil, err
+		}
+
+		camera := p.namedCamera()
+		camera.name = name
+		cameras = append(cameras, camera)
+	}
+
+	return cameras, nil
+}
+
+// parsePrintImage parses the print-image flags of a printer section, or of one of its cameras, from the
+// config file alone. The file isn't validated here as it also has the settings of the other commands.
+func (c *configFile) parsePrintImage(printer, cameraName string) (*printImage, error) {
+	var p printImage
+	resolver := &configResolver{cfg: c, printer: printer, camera: cameraName}
+	parser, err := kong.New(&p,
+		kong.Resolvers(kong.ResolverFunc(resolver.Resolve)),
+		kong.Exit(func(int) {}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := parser.Parse(nil); err != nil {
+		return nil, fmt.Errorf("printer %q: %w", printer, err)
+	}
+	p.PrinterName = printer
+
+	return &p, nil
+}
+
+// resolver returns a kong resolver for the printer section. An empty printer only resolves the top-level
+// values.
+func (c *configFile) resolver(printer string) kong.Resolver {
+	return &configResolver{cfg: c, printer: printer}
+}
+
+type configResolver struct {
+	cfg *configFile
+	// printer is the printer section to use. If it is empty, it is taken from the --printer flag.
+	printer string
+	// camera is the camera section of the printer to use, if any.
+	camera string
+}
+
+func (r *configResolver) Validate(app *kong.Application) error {
+	flags := map[string]bool{}
+	var collect func(node *kong.Node)
+	collect = func(node *kong.Node) {
+		for _, flag := range node.Flags {
+			flags[flag.Name] = true
+			for _, alias := range flag.Aliases {
+				flags[alias] = true
+			}
+		}
+		for _, child := range node.Children {
+			collect(child)
+		}
+	}
+	collect(app.Node)
+
+	check := func(section string, values map[string]any) error {
+		for key := range values {
+			if !flags[key] {
+				return fmt.Errorf("unknown setting %q in %s of the config file", key, section)
+			}
+		}
+		return nil
+	}
+
+	if err := check("the top-level", r.cfg.values); err != nil {
+		return err
+	}
+	for name, values := range r.cfg.printers {
+		if err := check(fmt.Sprintf("printer %q", name), values); err != nil {
+			return err
+		}
+	}
+	for printer, cameras := range r.cfg.cameras {
+		for name, values := range cameras {
+			section := fmt.Sprintf("camera %q of printer %q", name, printer)
+			if err := check(section, values); err != nil {
+				return err
+			}
+			for key := range values {
+				if !strings.HasPrefix(key, "camera-") && !strings.HasPrefix(key, "prusa-connect-") {
+					return fmt.Errorf("only camera and Prusa Connect settings can be set in %s of the config file, got %q", section, key)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (r *configResolver) Resolve(ctx *kong.Context, parent *kong.Path, flag *kong.Flag) (any, error) {
+	printer, err := r.selectedPrinter(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if printer != "" {
+		if r.camera != "" {
+			if v, ok := flagValue(r.cfg.cameras[printer][r.camera], flag); ok {
+				return resolvedValue(flag, v), nil
+			}
+		}
+		if v, ok := flagValue(r.cfg.printers[printer], flag); ok {
+			return resolvedValue(flag, v), nil
+		}
+	}
+
+	v, _ := flagValue(r.cfg.values, flag)
+	return resolvedValue(flag, v), nil
+}
+
+// flagValue returns the value of the flag in the settings, under its name or one of its deprecated aliases.
+func flagValue(values map[string]any, flag *kong.Flag) (any, bool) {
+	if v, ok := values[flag.Name]; ok {
+		return v, true
+	}
+	for _, alias := range flag.Aliases {
+		if v, ok := values[alias]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// resolvedValue passes lists to kong as values joined with the separator of the flag. Flags without a
+// separator, whose values can have commas, get the list as is.
+func resolvedValue(flag *kong.Flag, v any) any {
+	values, ok := v.([]string)
+	if !ok {
+		return v
+	}
+
+	if flag.Tag.Sep == -1 {
+		list := make([]any, 0, len(values))
+		for _, value := range values {
+			list = append(list, value)
+		}
+		return list
+	}
+
+	return strings.Join(values, string(flag.Tag.Sep))
+}
+
+func (r *configResolver) selectedPrinter(ctx *kong.Context) (string, error) {
+	if r.printer != "" {
+		return r.printer, nil
+	}
+
+	printer := ""
+	for _, flag := range ctx.Flags() {
+		if flag.Name == "printer" {
+			printer, _ = ctx.FlagValue(flag).(string)
+		}
+	}
+
+	return r.cfg.selectPrinter(printer)
+}
+
+// ConfigLoader is a kong.ConfigurationLoader for the YAML config file.
+func ConfigLoader(r io.Reader) (kong.Resolver, error) {
+	cfg, err := parseConfigFile(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.resolver(""), nil
+}
+
+// reloadConfig parses the command line again against the current contents of the config file, so that
+// flags still override the file.
+func reloadConfig() (*prusaLGTM, error) {
+	var root prusaLGTM
+	parser, err := kong.New(&root,
+		kong.Configuration(ConfigLoader),
+		kong.Exit(func(int) {}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := parser.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+
+	return &root, nil
+}
+
+// readSecret returns the trimmed contents of file if it is set, and value otherwise. This keeps credentials
+// out of the command line, where they show up in ps.
+func readSecret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+
+	contents, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret: %w", err)
+	}
+
+	return strings.TrimSpace(string(contents)), nil
+}
@@ -0,0 +1,356 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DatasetExportConfig struct {
+	Dir         string   `kong:"help='Save the frames the detector saw, with the detections as labels, to this directory. Correct the labels in a labelling tool to fine-tune the ML model.',optional,name='export-dir',type='path'"`
+	Formats     []string `kong:"help='The label formats to save.',default='coco,yolo,voc',enum='coco,yolo,voc',name='export-formats'"`
+	EmptyFrames bool     `kong:"help='Also save the frames without detections, to label the failures the detector missed. In print-image this is every frame that goes through the detector.',name='export-empty-frames'"`
+}
+
+const (
+	// failureClass is the class of the failures, the only one of the exported labels.
+	failureClass = "failure"
+
+	exportCOCOFile = "annotations.json"
+	// exportCOCOFlushInterval is how often annotations.json is written while frames are added. Writing it
+	// for every frame gets slow as the dataset grows.
+	exportCOCOFlushInterval = 30 * time.Second
+)
+
+var (
+	datasetExportersMtx sync.Mutex
+	// datasetExporters are by directory, so the printers of a farm can share one.
+	datasetExporters = map[string]*datasetExporter{}
+)
+
+// datasetExporter saves frames and their detections as a dataset: the frames in images/, the YOLO labels in
+// labels/, the Pascal VOC labels in annotations/ and the COCO labels of all the frames in annotations.json.
+// Frames saved again under the same name replace the old ones. annotations.json is written every
+// exportCOCOFlushInterval by run and add, and by flush.
+type datasetExporter struct {
+	cfg DatasetExportConfig
+
+	mtx  sync.Mutex
+	coco cocoDataset
+	// The IDs of the next image and annotation, so they aren't searched for on every frame.
+	nextImageID      int
+	nextAnnotationID int
+	dirty            bool
+	lastFlush        time.Time
+}
+
+// newDatasetExporter returns nil without an export directory.
+func newDatasetExporter(cfg DatasetExportConfig) (*datasetExporter, error) {
+	if cfg.Dir == "" {
+		return nil, nil
+	}
+
+	dir, err := filepath.Abs(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	datasetExportersMtx.Lock()
+	defer datasetExportersMtx.Unlock()
+	if e, ok := datasetExporters[dir]; ok {
+		return e, nil
+	}
+
+	for _, sub := range []string{"images", "labels", "annotations"} {
+		if err := os.MkdirAll(filepath.Join(cfg.Dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	e := &datasetExporter{
+		cfg:  cfg,
+		coco: cocoDataset{Categories: []cocoCategory{{ID: 1, Name: failureClass}}},
+	}
+	// Keep the frames of the previous runs.
+	if data, err := os.ReadFile(filepath.Join(cfg.Dir, exportCOCOFile)); err == nil {
+		if err := json.Unmarshal(data, &e.coco); err != nil {
+			return nil, fmt.Errorf("invalid %s in --export-dir: %w", exportCOCOFile, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	e.nextImageID, e.nextAnnotationID = 1, 1
+	for _, img := range e.coco.Images {
+		e.nextImageID = max(e.nextImageID, img.ID+1)
+	}
+	for _, annotation := range e.coco.Annotations {
+		e.nextAnnotationID = max(e.nextAnnotationID, annotation.ID+1)
+	}
+	e.lastFlush = time.Now()
+	// YOLO has the class names in a file of their own.
+	if err := os.WriteFile(filepath.Join(cfg.Dir, "labels", "classes.txt"), []byte(failureClass+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+
+	datasetExporters[dir] = e
+	return e, nil
+}
+
+func (e *datasetExporter) hasFormat(format string) bool {
+	return slices.Contains(e.cfg.Formats, format)
+}
+
+// exportObserver saves the frames of the detections of a printer.
+type exportObserver struct {
+	exporter *datasetExporter
+	printer  string
+}
+
+func (o exportObserver) observe(_ context.Context, d detection) {
+	// The labels are the detections, a frame the detector didn't see has none.
+	if !d.detected {
+		return
+	}
+	name := exportName(o.printer, d.camera, d.captured)
+	if err := o.exporter.add(name, d.frame, nil, d.failures); err != nil {
+		newLogger(o.printer, d.camera).Println("failed to export frame:", err)
+	}
+}
+
+// exportName is the name of a frame in the dataset, unique per camera.
+func exportName(printer, camera string, t time.Time) string {
+	name := t.UTC().Format("20060102T150405.000000000Z")
+	if camera != "" {
+		name = mqttID(camera) + "-" + name
+	}
+	if printer != "" {
+		name = mqttID(printer) + "-" + name
+	}
+	return name
+}
+
+// add saves the frame and its labels. data is the JPEG of the frame if there is one already, so it's saved
+// as is.
+func (e *datasetExporter) add(name string, img image.Image, data []byte, failures []detectedFailure) error {
+	if len(failures) == 0 && !e.cfg.EmptyFrames {
+		return nil
+	}
+
+	if data == nil {
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 95}); err != nil {
+			return err
+		}
+		data = buf.Bytes()
+	}
+
+	fileName := name + ".jpg"
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if err := writeFileAtomic(filepath.Join(e.cfg.Dir, "images", fileName), data); err != nil {
+		return err
+	}
+
+	if e.hasFormat("yolo") {
+		if err := writeFileAtomic(filepath.Join(e.cfg.Dir, "labels", name+".txt"), yoloLabels(failures, width, height)); err != nil {
+			return err
+		}
+	}
+
+	if e.hasFormat("voc") {
+		voc, err := vocLabels(fileName, failures, width, height)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(filepath.Join(e.cfg.Dir, "annotations", name+".xml"), voc); err != nil {
+			return err
+		}
+	}
+
+	if e.hasFormat("coco") {
+		return e.addCOCO(fileName, failures, width, height)
+	}
+
+	return nil
+}
+
+// yoloLabels returns a line of class, x, y, width and height per failure, relative to the size of the frame.
+func yoloLabels(failures []detectedFailure, width, height int) []byte {
+	buf := new(bytes.Buffer)
+	for _, failure := range failures {
+		box := failure.BoxCoordinates
+		fmt.Fprintf(buf, "0 %.6f %.6f %.6f %.6f\n", box[0]/float64(width), box[1]/float64(height), box[2]/float64(width), box[3]/float64(height))
+	}
+	return buf.Bytes()
+}
+
+type vocAnnotation struct {
+	XMLName  xml.Name    `xml:"annotation"`
+	Folder   string      `xml:"folder"`
+	Filename string      `xml:"filename"`
+	Size     vocSize     `xml:"size"`
+	Objects  []vocObject `xml:"object"`
+}
+
+type vocSize struct {
+	Width  int `xml:"width"`
+	Height int `xml:"height"`
+	Depth  int `xml:"depth"`
+}
+
+type vocObject struct {
+	Name      string `xml:"name"`
+	Pose      string `xml:"pose"`
+	Truncated int    `xml:"truncated"`
+	Difficult int    `xml:"difficult"`
+	BndBox    struct {
+		XMin int `xml:"xmin"`
+		YMin int `xml:"ymin"`
+		XMax int `xml:"xmax"`
+		YMax int `xml:"ymax"`
+	} `xml:"bndbox"`
+}
+
+// vocLabels returns the Pascal VOC XML of the frame, with the corners of the boxes in pixels from 1.
+func vocLabels(fileName string, failures []detectedFailure, width, height int) ([]byte, error) {
+	annotation := vocAnnotation{
+		Folder:   "images",
+		Filename: fileName,
+		Size:     vocSize{Width: width, Height: height, Depth: 3},
+	}
+	for _, failure := range failures {
+		box := failure.BoxCoordinates
+		object := vocObject{Name: failureClass, Pose: "Unspecified"}
+		object.BndBox.XMin = min(max(int(box[0]-box[2]/2)+1, 1), width)
+		object.BndBox.YMin = min(max(int(box[1]-box[3]/2)+1, 1), height)
+		object.BndBox.XMax = min(max(int(box[0]+box[2]/2), 1), width)
+		object.BndBox.YMax = min(max(int(box[1]+box[3]/2), 1), height)
+		// A box that goes out of the frame is cut.
+		if box[0]-box[2]/2 < 0 || box[1]-box[3]/2 < 0 || box[0]+box[2]/2 > float64(width) || box[1]+box[3]/2 > float64(height) {
+			object.Truncated = 1
+		}
+		annotation.Objects = append(annotation.Objects, object)
+	}
+
+	data, err := xml.MarshalIndent(annotation, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// addCOCO adds the frame to the COCO labels, and saves them if they weren't saved for
+// exportCOCOFlushInterval.
+func (e *datasetExporter) addCOCO(fileName string, failures []detectedFailure, width, height int) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	// Replace the frame if it was saved before.
+	if i := slices.IndexFunc(e.coco.Images, func(img cocoImage) bool { return img.FileName == fileName }); i >= 0 {
+		old := e.coco.Images[i].ID
+		e.coco.Images = slices.Delete(e.coco.Images, i, i+1)
+		e.coco.Annotations = slices.DeleteFunc(e.coco.Annotations, func(a cocoAnnotation) bool { return a.ImageID == old })
+	}
+
+	imageID := e.nextImageID
+	e.nextImageID++
+	e.coco.Images = append(e.coco.Images, cocoImage{ID: imageID, FileName: fileName, Width: width, Height: height})
+	for _, failure := range failures {
+		box := failure.BoxCoordinates
+		score := failure.Confidence
+		e.coco.Annotations = append(e.coco.Annotations, cocoAnnotation{
+			ID:         e.nextAnnotationID,
+			ImageID:    imageID,
+			CategoryID: 1,
+			BBox:       [4]float64{box[0] - box[2]/2, box[1] - box[3]/2, box[2], box[3]},
+			Area:       box[2] * box[3],
+			Score:      &score,
+		})
+		e.nextAnnotationID++
+	}
+	e.dirty = true
+
+	if time.Since(e.lastFlush) < exportCOCOFlushInterval {
+		return nil
+	}
+	return e.flushLocked()
+}
+
+// run saves the COCO labels every exportCOCOFlushInterval until ctx is done, so that annotations.json lists
+// the last frames of a job soon after they are saved, and a crash loses at most an interval of them.
+func (e *datasetExporter) run(ctx context.Context, log logger) {
+	ticker := time.NewTicker(exportCOCOFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.flush(); err != nil {
+				log.Println("failed to save the exported labels:", err)
+			}
+		}
+	}
+}
+
+// flush saves the COCO labels of the frames added since they were last saved.
+func (e *datasetExporter) flush() error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	return e.flushLocked()
+}
+
+func (e *datasetExporter) flushLocked() error {
+	if !e.dirty {
+		return nil
+	}
+
+	data, err := json.Marshal(e.coco)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(e.cfg.Dir, exportCOCOFile), data); err != nil {
+		return err
+	}
+
+	e.dirty = false
+	e.lastFlush = time.Now()
+	return nil
+}
+
+// writeFileAtomic writes the file through a temporary file, so a labelling tool never reads half of it.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+strings.TrimPrefix(filepath.Base(path), ".")+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,259 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"image"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promDetectionQueueLength = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "detection_queue_length",
+			Help:      "The number of frames waiting for the ML API.",
+		},
+		[]string{"printer", "camera"},
+	)
+	promDetectionDropped = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "detection_frames_dropped_total",
+			Help:      "The number of frames dropped from a full detection queue without going through the ML API.",
+		},
+		[]string{"printer", "camera"},
+	)
+	promDetectionLag = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prusalgtm",
+			Name:      "detection_lag_seconds",
+			Help:      "The time from capturing a frame to having its detection result.",
+			Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+		},
+		[]string{"printer", "camera"},
+	)
+)
+
+type detectionFrame struct {
+	img      image.Image
+	captured time.Time
+	// detect is false for the frames that are only for the first layer inspector.
+	detect bool
+}
+
+// detectionWorker runs the detector on the frames of a camera in the background, so that a slow ML API
+// doesn't hold up logging. The queue is bounded, and the oldest frame is dropped when it's full: the
+// latest frame is the one that matters for spotting a failure.
+type detectionWorker struct {
+	// detector is nil when the worker only inspects the first layer.
+	detector  *failureDetector
+	overlay   *overlay
+	inspector *firstLayerInspector
+	score     *failureScore
+	observers []detectionObserver
+	view      *liveView
+	log       logger
+	size      int
+
+	mtx    sync.Mutex
+	queue  []detectionFrame
+	closed bool
+	// ready has a value when there are frames in the queue or the worker was closed.
+	ready chan struct{}
+}
+
+func newDetectionWorker(detector *failureDetector, overlay *overlay, inspector *firstLayerInspector, score *failureScore, observers []detectionObserver, view *liveView, size int, log logger) *detectionWorker {
+	promDetectionQueueLength.WithLabelValues(log.printer, log.camera).Set(0)
+
+	return &detectionWorker{
+		detector:  detector,
+		overlay:   overlay,
+		inspector: inspector,
+		score:     score,
+		observers: observers,
+		view:      view,
+		log:       log,
+		size:      max(size, 1),
+		ready:     make(chan struct{}, 1),
+	}
+}
+
+// enqueue adds a frame to the queue, dropping the oldest frame if it's full. It never blocks. Without detect
+// the frame only goes to the first layer inspector.
+func (w *detectionWorker) enqueue(img image.Image, detect bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return
+	}
+
+	if len(w.queue) >= w.size {
+		w.queue = w.queue[1:]
+		promDetectionDropped.WithLabelValues(w.log.printer, w.log.camera).Inc()
+	}
+	w.queue = append(w.queue, detectionFrame{img: img, captured: time.Now(), detect: detect})
+	promDetectionQueueLength.WithLabelValues(w.log.printer, w.log.camera).Set(float64(len(w.queue)))
+
+	w.wakeUp()
+}
+
+// close stops the worker once the frame it's working on is done. The frames still in the queue are dropped.
+func (w *detectionWorker) close() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	w.closed = true
+	w.queue = nil
+	promDetectionQueueLength.WithLabelValues(w.log.printer, w.log.camera).Set(0)
+
+	w.wakeUp()
+}
+
+// healthCheck reports the frames waiting for the detector. The queue drops the oldest once it's full.
+func (w *detectionWorker) healthCheck() healthCheck {
+	return func() componentHealth {
+		w.mtx.Lock()
+		defer w.mtx.Unlock()
+
+		return componentHealth{
+			Component: "detection",
+			Printer:   w.log.printer,
+			Camera:    w.log.camera,
+			Healthy:   true,
+			Ready:     true,
+			Details:   map[string]any{"backlog": len(w.queue), "backlog_size": w.size},
+		}
+	}
+}
+
+// wakeUp must be called with mtx held.
+func (w *detectionWorker) wakeUp() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (w *detectionWorker) next() (detectionFrame, bool, bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if w.closed {
+		return detectionFrame{}, false, true
+	}
+	if len(w.queue) == 0 {
+		return detectionFrame{}, false, false
+	}
+
+	frame := w.queue[0]
+	w.queue = w.queue[1:]
+	promDetectionQueueLength.WithLabelValues(w.log.printer, w.log.camera).Set(float64(len(w.queue)))
+
+	return frame, true, false
+}
+
+// run runs the detector on the queued frames until the worker is closed or ctx is done. The results go to
+// the observers and the annotated frames to the live view.
+func (w *detectionWorker) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-w.ready:
+		}
+
+		for {
+			frame, ok, closed := w.next()
+			if closed {
+				return
+			}
+			if !ok {
+				break
+			}
+
+			w.detect(ctx, frame)
+		}
+	}
+}
+
+func (w *detectionWorker) detect(ctx context.Context, frame detectionFrame) {
+	var (
+		failures []detectedFailure
+		err      error
+	)
+	if frame.detect {
+		failures, err = w.detector.detect(ctx, w.log.camera, frame.img)
+		if ctx.Err() != nil {
+			// Shutting down.
+			return
+		}
+	}
+
+	// The first layer is inspected even when the ML API is down.
+	var (
+		defects          []detectedFailure
+		firstLayerFailed bool
+	)
+	if w.inspector != nil {
+		defects, firstLayerFailed = w.inspector.inspect(frame.img)
+	}
+
+	if err != nil {
+		// The detector logs when it stops sending frames, not for every frame it skips.
+		if !errors.Is(err, errMLAPIUnavailable) {
+			w.log.Println("detection failure", err)
+		}
+	}
+	detected := frame.detect && err == nil
+	if !detected && len(defects) == 0 {
+		return
+	}
+
+	d := detection{
+		camera:           w.log.camera,
+		frame:            frame.img,
+		captured:         frame.captured,
+		detected:         detected,
+		overlay:          w.overlay,
+		failures:         failures,
+		defects:          defects,
+		firstLayerFailed: firstLayerFailed,
+	}
+	if detected {
+		lag := time.Since(frame.captured)
+		promDetectionLag.WithLabelValues(w.log.printer, w.log.camera).Observe(lag.Seconds())
+		if len(failures) > 0 {
+			confidence := 0.0
+			for _, failure := range failures {
+				confidence = max(confidence, failure.Confidence)
+			}
+			w.log.Printf("detected %d failures, max confidence %.2f, in the frame from %s ago\n", len(failures), confidence, lag.Round(time.Millisecond))
+		}
+
+		d.score, d.level, d.previousLevel = w.score.observe(failures)
+		if d.level != d.previousLevel {
+			w.log.Printf("failure score %.2f, level changed from %s to %s\n", d.score, d.previousLevel, d.level)
+		}
+	} else {
+		// Only the frames the detector saw are scored.
+		d.score, d.level = w.score.current()
+		d.previousLevel = d.level
+	}
+
+	if w.view != nil {
+		w.view.setAnnotated(func() image.Image { return d.annotatedAt(0) })
+	}
+	// A frame the detector didn't see only matters to the observers if it failed the first layer.
+	if !detected && !firstLayerFailed {
+		return
+	}
+	for _, observer := range w.observers {
+		observer.observe(ctx, d)
+	}
+}
@@ -0,0 +1,166 @@
+package cli
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/gg"
+)
+
+// detectionZone is a polygon in frame coordinates, parsed from a space separated list of x,y points, eg.
+// "0,600 200,600 200,720 0,720".
+type detectionZone []zonePoint
+
+type zonePoint struct {
+	X, Y float64
+}
+
+func (z *detectionZone) UnmarshalText(text []byte) error {
+	*z = nil
+
+	for _, point := range strings.Fields(string(text)) {
+		x, y, ok := strings.Cut(point, ",")
+		if !ok {
+			return fmt.Errorf("invalid zone point %q, expected x,y", point)
+		}
+
+		px, err := strconv.ParseFloat(x, 64)
+		if err != nil {
+			return fmt.Errorf("invalid zone point %q: %w", point, err)
+		}
+		py, err := strconv.ParseFloat(y, 64)
+		if err != nil {
+			return fmt.Errorf("invalid zone point %q: %w", point, err)
+		}
+
+		*z = append(*z, zonePoint{X: px, Y: py})
+	}
+
+	if len(*z) < 3 {
+		return fmt.Errorf("invalid zone %q, expected at least 3 points", text)
+	}
+
+	return nil
+}
+
+func (z detectionZone) String() string {
+	points := make([]string, 0, len(z))
+	for _, p := range z {
+		points = append(points, strconv.FormatFloat(p.X, 'f', -1, 64)+","+strconv.FormatFloat(p.Y, 'f', -1, 64))
+	}
+	return strings.Join(points, " ")
+}
+
+// contains uses the even-odd rule, so the polygon can be concave.
+func (z detectionZone) contains(x, y float64) bool {
+	inside := false
+	for i, j := 0, len(z)-1; i < len(z); j, i = i, i+1 {
+		a, b := z[i], z[j]
+		if (a.Y > y) != (b.Y > y) && x < (b.X-a.X)*(y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// detectionZones are the areas of the frame where detections count. With include zones, only detections
+// inside them count, and detections inside exclude zones never count.
+type detectionZones struct {
+	include []detectionZone
+	exclude []detectionZone
+	// overlap is the fraction of a box that has to be in the excluded area to drop the detection.
+	overlap float64
+}
+
+func (z detectionZones) empty() bool {
+	return len(z.include) == 0 && len(z.exclude) == 0
+}
+
+func (z detectionZones) excluded(x, y float64) bool {
+	for _, zone := range z.exclude {
+		if zone.contains(x, y) {
+			return true
+		}
+	}
+	if len(z.include) == 0 {
+		return false
+	}
+	for _, zone := range z.include {
+		if zone.contains(x, y) {
+			return false
+		}
+	}
+	return true
+}
+
+// excludedFraction returns the fraction of the box, in x, y of the center, width, height, that is in the
+// excluded area. It's estimated from a grid of samples in the box.
+func (z detectionZones) excludedFraction(box [4]float64) float64 {
+	const samples = 16
+
+	excluded := 0
+	for i := 0; i < samples; i++ {
+		for j := 0; j < samples; j++ {
+			x := box[0] - box[2]/2 + (float64(i)+0.5)*box[2]/samples
+			y := box[1] - box[3]/2 + (float64(j)+0.5)*box[3]/samples
+			if z.excluded(x, y) {
+				excluded++
+			}
+		}
+	}
+
+	return float64(excluded) / (samples * samples)
+}
+
+// filter drops the failures that are mostly in the excluded area.
+func (z detectionZones) filter(failures []detectedFailure) []detectedFailure {
+	if z.empty() {
+		return failures
+	}
+
+	filtered := make([]detectedFailure, 0, len(failures))
+	for _, failure := range failures {
+		if z.excludedFraction(failure.BoxCoordinates) >= z.overlap {
+			continue
+		}
+		filtered = append(filtered, failure)
+	}
+
+	return filtered
+}
+
+// draw returns the image with the excluded zones shaded and the include zones outlined in green.
+func (z detectionZones) draw(img image.Image) image.Image {
+	if z.empty() {
+		return img
+	}
+
+	ggCtx := gg.NewContextForImage(img)
+	ggCtx.SetLineWidth(2)
+
+	path := func(zone detectionZone) {
+		ggCtx.NewSubPath()
+		for _, p := range zone {
+			ggCtx.LineTo(p.X, p.Y)
+		}
+		ggCtx.ClosePath()
+	}
+
+	for _, zone := range z.exclude {
+		path(zone)
+		ggCtx.SetColor(color.NRGBA{255, 0, 255, 80})
+		ggCtx.FillPreserve()
+		ggCtx.SetColor(color.NRGBA{255, 0, 255, 255})
+		ggCtx.Stroke()
+	}
+	for _, zone := range z.include {
+		path(zone)
+		ggCtx.SetColor(color.NRGBA{0, 255, 0, 255})
+		ggCtx.Stroke()
+	}
+
+	return ggCtx.Image()
+}
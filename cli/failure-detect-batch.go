@@ -0,0 +1,467 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/loki/pkg/loghttp"
+)
+
+// batchFrame is a frame to detect failures in, from a file or a log line in Loki.
+type batchFrame struct {
+	index   int
+	source  string
+	time    time.Time
+	printer string
+	camera  string
+	jpeg    []byte
+	err     error
+}
+
+// batchResult is the detection result of a frame, as it goes in the report.
+type batchResult struct {
+	Source   string            `json:"source"`
+	Time     time.Time         `json:"time"`
+	Printer  string            `json:"printer,omitempty"`
+	Camera   string            `json:"camera,omitempty"`
+	Failures []detectedFailure `json:"failures"`
+	Score    float64           `json:"score"`
+	Level    string            `json:"level"`
+	Error    string            `json:"error,omitempty"`
+}
+
+// batchTimelineEvent is when failures first appeared on a camera, and when its failure score changed level.
+type batchTimelineEvent struct {
+	Printer string    `json:"printer,omitempty"`
+	Camera  string    `json:"camera,omitempty"`
+	Event   string    `json:"event"`
+	Source  string    `json:"source"`
+	Time    time.Time `json:"time"`
+	Score   float64   `json:"score"`
+}
+
+type batchReport struct {
+	Frames   []batchResult        `json:"frames"`
+	Timeline []batchTimelineEvent `json:"timeline"`
+}
+
+// isBatch is true unless a single image file is checked, like before batches were supported.
+func (f *failureDetectImagesCommand) isBatch() bool {
+	if len(f.ImagePaths) != 1 || f.LokiURL != "" || f.ReportPath != "" || f.OutputDir != "" {
+		return true
+	}
+
+	info, err := os.Stat(f.ImagePaths[0])
+	return err != nil || info.IsDir()
+}
+
+// runBatch detects failures in all the frames of the image paths and of Loki, Concurrency frames at a time.
+func (f *failureDetectImagesCommand) runBatch(ctx context.Context, detector *failureDetector, detectionCfg DetectionConfig) error {
+	if f.OutputPath != "" {
+		return fmt.Errorf("--output-path only works with a single image, use --output-dir for more")
+	}
+	if f.LokiURL != "" && (f.StartTime.IsZero() || f.EndTime.IsZero()) {
+		return fmt.Errorf("--loki-url requires --start-time and --end-time")
+	}
+	if f.OutputDir != "" {
+		if err := os.MkdirAll(f.OutputDir, 0o755); err != nil {
+			return err
+		}
+	}
+
+	files, err := f.imageFiles()
+	if err != nil {
+		return err
+	}
+	exporter, err := newDatasetExporter(f.DatasetExportConfig)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	frames := make(chan batchFrame, f.Concurrency)
+	sourceErr := make(chan error, 1)
+	go func() {
+		defer close(frames)
+		sourceErr <- f.readFrames(ctx, files, frames)
+	}()
+
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		results []batchResult
+		indexes []int
+	)
+	// The heuristics compare every frame with the ones before, so they take the frames one at a time.
+	workers := max(f.Concurrency, 1)
+	if detector.heuristics != nil {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for frame := range frames {
+				result := f.detectBatchFrame(ctx, detector, exporter, frame)
+
+				mtx.Lock()
+				results = append(results, result)
+				indexes = append(indexes, frame.index)
+				mtx.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if exporter != nil {
+		if err := exporter.flush(); err != nil {
+			return err
+		}
+	}
+	if err := <-sourceErr; err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+
+	// The frames are done out of order, the score and the report go in the order the frames were read.
+	sort.Sort(byIndex{results, indexes})
+	report := batchReport{Frames: results, Timeline: scoreBatch(results, detectionCfg)}
+	f.printBatchSummary(report)
+
+	if f.ReportPath == "" {
+		return nil
+	}
+	return f.writeReport(report)
+}
+
+type byIndex struct {
+	results []batchResult
+	indexes []int
+}
+
+func (b byIndex) Len() int           { return len(b.results) }
+func (b byIndex) Less(i, j int) bool { return b.indexes[i] < b.indexes[j] }
+func (b byIndex) Swap(i, j int) {
+	b.results[i], b.results[j] = b.results[j], b.results[i]
+	b.indexes[i], b.indexes[j] = b.indexes[j], b.indexes[i]
+}
+
+// imageFiles expands the image paths: the JPEGs of a directory sorted by name, and the matches of a glob.
+func (f *failureDetectImagesCommand) imageFiles() ([]string, error) {
+	var files []string
+	for _, path := range f.ImagePaths {
+		info, err := os.Stat(path)
+		switch {
+		case err == nil && info.IsDir():
+			entries, err := os.ReadDir(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				ext := strings.ToLower(filepath.Ext(entry.Name()))
+				if !entry.IsDir() && (ext == ".jpg" || ext == ".jpeg") {
+					files = append(files, filepath.Join(path, entry.Name()))
+				}
+			}
+		case err == nil:
+			files = append(files, path)
+		default:
+			matches, globErr := filepath.Glob(path)
+			if globErr != nil {
+				return nil, fmt.Errorf("invalid --image-path %q: %w", path, globErr)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no images found for --image-path %q: %w", path, err)
+			}
+			sort.Strings(matches)
+			files = append(files, matches...)
+		}
+	}
+
+	return files, nil
+}
+
+// readFrames sends the frames of the files, then the frames logged in Loki, until ctx is done.
+func (f *failureDetectImagesCommand) readFrames(ctx context.Context, files []string, frames chan<- batchFrame) error {
+	index := 0
+	send := func(frame batchFrame) bool {
+		frame.index = index
+		index++
+
+		select {
+		case frames <- frame:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	for _, file := range files {
+		frame := batchFrame{source: file}
+		if info, err := os.Stat(file); err == nil {
+			frame.time = info.ModTime()
+		}
+		frame.jpeg, frame.err = os.ReadFile(file)
+		if !send(frame) {
+			return nil
+		}
+	}
+
+	if f.LokiURL == "" {
+		return nil
+	}
+
+	password, err := readSecret(f.LokiPassword, f.LokiPasswordFile)
+	if err != nil {
+		return err
+	}
+	client := newLokiClient(f.LokiURL, f.LogQLQuery, f.LokiUsername, password)
+
+	// Each line is 200KB, so fetch 5mins at once like generate-timelapse.
+	for start := f.StartTime; start.Before(f.EndTime); {
+		end := start.Add(5 * time.Minute)
+		if end.After(f.EndTime) {
+			end = f.EndTime
+		}
+
+		resp, err := client.fetchLogs(ctx, start, end, 1000)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to fetch logs: %w", err)
+		}
+		start = end
+
+		if resp.Data.Result.Type() != loghttp.ResultTypeStream {
+			return fmt.Errorf("unexpected result type: %s", resp.Data.ResultType)
+		}
+
+		// In farm mode every printer and camera can be a stream of its own, the frames go in time order.
+		var entries []loghttp.Entry
+		for _, stream := range resp.Data.Result.(loghttp.Streams) {
+			entries = append(entries, stream.Entries...)
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+
+		for _, entry := range entries {
+			frame := batchFrame{source: "loki:" + entry.Timestamp.Format(time.RFC3339Nano), time: entry.Timestamp}
+			frame.printer, frame.camera, frame.jpeg, frame.err = parseImageLogLine(entry.Line)
+			if !send(frame) {
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f *failureDetectImagesCommand) detectBatchFrame(ctx context.Context, detector *failureDetector, exporter *datasetExporter, frame batchFrame) batchResult {
+	result := batchResult{
+		Source:  frame.source,
+		Time:    frame.time,
+		Printer: frame.printer,
+		Camera:  frame.camera,
+	}
+
+	err := frame.err
+	if err == nil {
+		var img, annotated image.Image
+		img, annotated, result.Failures, err = f.detectJPEG(ctx, detector, frame.camera, frame.jpeg)
+		if err == nil && len(result.Failures) > 0 && f.OutputDir != "" {
+			err = f.writeAnnotated(frame, annotated)
+		}
+		if err == nil && exporter != nil {
+			err = exporter.add(frame.name(), img, frame.jpeg, result.Failures)
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		fmt.Printf("%s: %v\n", frame.source, err)
+		return result
+	}
+
+	for _, failure := range result.Failures {
+		fmt.Printf("%s: failure detected with confidence %f at coordinates %v\n", frame.source, failure.Confidence, failure.BoxCoordinates)
+	}
+
+	return result
+}
+
+// detectJPEG returns the frame, the frame with the failures drawn on it and the failures.
+func (f *failureDetectImagesCommand) detectJPEG(ctx context.Context, detector *failureDetector, camera string, data []byte) (image.Image, image.Image, []detectedFailure, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to decode jpeg image: %w", err)
+	}
+
+	annotated, failures, err := detector.DetectFailure(ctx, camera, img)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if f.DebugZones {
+		annotated = detector.zones.draw(annotated)
+	}
+
+	return img, annotated, failures, nil
+}
+
+// name is the file name of the frame without the extension: the name of its file, or the printer, camera
+// and time of a frame from Loki.
+func (frame batchFrame) name() string {
+	if strings.HasPrefix(frame.source, "loki:") {
+		return exportName(frame.printer, frame.camera, frame.time)
+	}
+	return strings.TrimSuffix(filepath.Base(frame.source), filepath.Ext(frame.source))
+}
+
+// writeAnnotated writes the frame with the failures drawn on it to the output directory.
+func (f *failureDetectImagesCommand) writeAnnotated(frame batchFrame, annotated image.Image) error {
+	out, err := os.Create(filepath.Join(f.OutputDir, frame.name()+".jpg"))
+	if err != nil {
+		return err
+	}
+	if err := jpeg.Encode(out, annotated, &jpeg.Options{Quality: 90}); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// scoreBatch runs the failure score of every camera over the results, and returns the timeline of when
+// failures first appeared and when the score changed level.
+func scoreBatch(results []batchResult, detectionCfg DetectionConfig) []batchTimelineEvent {
+	var timeline []batchTimelineEvent
+
+	type cameraKey struct{ printer, camera string }
+	scores := map[cameraKey]*failureScore{}
+	seenFailure := map[cameraKey]bool{}
+
+	for i := range results {
+		result := &results[i]
+		key := cameraKey{result.Printer, result.Camera}
+		score, ok := scores[key]
+		if !ok {
+			score = newFailureScore(detectionCfg, newLogger(key.printer, key.camera))
+			scores[key] = score
+		}
+		if result.Error != "" {
+			continue
+		}
+
+		value, level, previous := score.observe(result.Failures)
+		result.Score, result.Level = value, level.String()
+
+		event := func(name string) {
+			timeline = append(timeline, batchTimelineEvent{
+				Printer: key.printer,
+				Camera:  key.camera,
+				Event:   name,
+				Source:  result.Source,
+				Time:    result.Time,
+				Score:   value,
+			})
+		}
+		if len(result.Failures) > 0 && !seenFailure[key] {
+			seenFailure[key] = true
+			event("first_failure")
+		}
+		if level != previous {
+			event(level.String())
+		}
+	}
+
+	return timeline
+}
+
+func (f *failureDetectImagesCommand) printBatchSummary(report batchReport) {
+	withFailures, failed := 0, 0
+	for _, result := range report.Frames {
+		if result.Error != "" {
+			failed++
+		} else if len(result.Failures) > 0 {
+			withFailures++
+		}
+	}
+	fmt.Printf("checked %d frames: %d with failures, %d errors\n", len(report.Frames), withFailures, failed)
+
+	for _, event := range report.Timeline {
+		fmt.Printf("%s%s at %s (%s), score %.2f\n", newLogger(event.Printer, event.Camera).prefix, event.Event, event.Time.Format(time.RFC3339), event.Source, event.Score)
+	}
+}
+
+func (f *failureDetectImagesCommand) writeReport(report batchReport) error {
+	out, err := os.Create(f.ReportPath)
+	if err != nil {
+		return err
+	}
+
+	if f.ReportFormat == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeCSVReport(out, report.Frames)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+// writeCSVReport writes a row per frame. The detections are space separated confidence@x,y,width,height.
+func writeCSVReport(w io.Writer, results []batchResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"source", "time", "printer", "camera", "failures", "max_confidence", "score", "level", "detections", "error"})
+
+	float := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, result := range results {
+		maxConfidence := 0.0
+		detections := make([]string, 0, len(result.Failures))
+		for _, failure := range result.Failures {
+			maxConfidence = max(maxConfidence, failure.Confidence)
+			box := failure.BoxCoordinates
+			detections = append(detections, fmt.Sprintf("%s@%s,%s,%s,%s", float(failure.Confidence), float(box[0]), float(box[1]), float(box[2]), float(box[3])))
+		}
+
+		timestamp := ""
+		if !result.Time.IsZero() {
+			timestamp = result.Time.Format(time.RFC3339Nano)
+		}
+
+		cw.Write([]string{
+			result.Source,
+			timestamp,
+			result.Printer,
+			result.Camera,
+			strconv.Itoa(len(result.Failures)),
+			float(maxConfidence),
+			float(result.Score),
+			result.Level,
+			strings.Join(detections, " "),
+			result.Error,
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,401 @@
+package cli
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+type failureDetectEvaluateCommand struct {
+	DatasetPath  string    `kong:"help='The directory with the images of the dataset.',required,name='dataset-path',type='existingdir'"`
+	LabelsFormat string    `kong:"help='The format of the labels. yolo has a txt file per image, coco a single JSON file.',default='yolo',enum='yolo,coco',name='labels-format'"`
+	LabelsPath   string    `kong:"help='The directory of the YOLO labels, by default labels/ next to an images/ dataset directory or the dataset directory itself. The JSON file of the COCO labels.',optional,name='labels-path',type='path'"`
+	Classes      []string  `kong:"help='The classes of the labels that are failures, as YOLO class ids or COCO category names. All of them by default.',optional,name='classes'"`
+	IoUThreshold float64   `kong:"help='The minimum intersection over union of a detection and a label for the detection to find the failure.',default='0.5',name='iou-threshold'"`
+	Thresholds   []float64 `kong:"help='The confidence thresholds to report precision and recall at.',default='0.1,0.2,0.3,0.4,0.5,0.6,0.7,0.8,0.9',name='thresholds'"`
+	ReportPath   string    `kong:"help='Write the results to this file, to compare ML API versions.',optional,name='report-path',type='path'"`
+	ReportFormat string    `kong:"help='The format of the report.',default='json',enum='json,csv',name='report-format'"`
+	Concurrency  int       `kong:"help='The number of images sent to the ML API at once.',default='4',name='concurrency'"`
+}
+
+// evaluationImage is an image of the dataset and what the detector found in it.
+type evaluationImage struct {
+	path     string
+	labels   [][4]float64
+	failures []detectedFailure
+	err      error
+}
+
+// evaluationCounts are the results at a threshold, of the boxes or of the frames. A frame is positive when
+// it has a label or a detection, TN is only counted for frames.
+type evaluationCounts struct {
+	TP        int     `json:"tp"`
+	FP        int     `json:"fp"`
+	FN        int     `json:"fn"`
+	TN        int     `json:"tn,omitempty"`
+	Precision float64 `json:"precision"`
+	Recall    float64 `json:"recall"`
+	F1        float64 `json:"f1"`
+}
+
+type evaluationResult struct {
+	Threshold float64 `json:"threshold"`
+	// Boxes counts every label and detection, matched by IoU.
+	Boxes evaluationCounts `json:"boxes"`
+	// Frames counts the frames, which is what pausing a print depends on.
+	Frames evaluationCounts `json:"frames"`
+}
+
+type evaluationReport struct {
+	Detector     string             `json:"detector"`
+	MLAPIURL     string             `json:"ml_api_url,omitempty"`
+	Time         time.Time          `json:"time"`
+	Images       int                `json:"images"`
+	Labels       int                `json:"labels"`
+	Errors       int                `json:"errors"`
+	IoUThreshold float64            `json:"iou_threshold"`
+	Results      []evaluationResult `json:"results"`
+	// Best is the result with the highest F1 of the boxes.
+	Best *evaluationResult `json:"best"`
+}
+
+func (f *failureDetectEvaluateCommand) Run(ctx context.Context, parent *failureDetectCommand) error {
+	// The heuristics compare every frame with the ones before, the images of a dataset aren't a sequence.
+	if parent.Detector == detectorHeuristic {
+		return fmt.Errorf("failure-detect evaluate doesn't support --detector=heuristic, it needs the frames of a camera in order")
+	}
+	// The thresholds are what's being evaluated, so --detect-min-confidence mustn't drop the detections
+	// below it before they get there.
+	detectionCfg := parent.DetectionConfig
+	detectionCfg.MinConfidence = 0
+	detector, err := newFailureDetector(parent.MLAPIURL, parent.MLClientConfig, parent.HeuristicConfig, detectionCfg, newLogger("", ""))
+	if err != nil {
+		return err
+	}
+
+	images, err := f.datasetImages()
+	if err != nil {
+		return err
+	}
+	if len(images) == 0 {
+		return fmt.Errorf("no images found in %s", f.DatasetPath)
+	}
+
+	labelsFor, err := f.labels()
+	if err != nil {
+		return err
+	}
+
+	paths := make(chan int)
+	var wg sync.WaitGroup
+	// The heuristics compare every frame with the ones before, so they take the frames one at a time.
+	workers := max(f.Concurrency, 1)
+	if detector.heuristics != nil {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range paths {
+				images[i].failures, images[i].labels, images[i].err = evaluateImage(ctx, detector, images[i].path, labelsFor)
+				if images[i].err != nil {
+					fmt.Printf("%s: %v\n", images[i].path, images[i].err)
+				}
+			}
+		}()
+	}
+	for i := range images {
+		select {
+		case paths <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(paths)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("interrupted: %w", ctx.Err())
+	}
+
+	report := f.evaluate(images)
+	report.Detector = parent.Detector
+	if parent.Detector == detectorMLAPI {
+		report.MLAPIURL = parent.MLAPIURL
+	}
+	f.printReport(os.Stdout, report)
+
+	if f.ReportPath == "" {
+		return nil
+	}
+	return f.writeReport(report)
+}
+
+// datasetImages returns the images of the dataset directory, sorted by name.
+func (f *failureDetectEvaluateCommand) datasetImages() ([]evaluationImage, error) {
+	entries, err := os.ReadDir(f.DatasetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var images []evaluationImage
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".jpg", ".jpeg", ".png":
+			if !entry.IsDir() {
+				images = append(images, evaluationImage{path: filepath.Join(f.DatasetPath, entry.Name())})
+			}
+		}
+	}
+
+	return images, nil
+}
+
+// labels returns the function that returns the labels of an image of the given size.
+func (f *failureDetectEvaluateCommand) labels() (func(path string, width, height int) ([][4]float64, error), error) {
+	if f.LabelsFormat == "coco" {
+		if f.LabelsPath == "" {
+			return nil, fmt.Errorf("--labels-format=coco requires --labels-path")
+		}
+		labels, err := readCOCOLabels(f.LabelsPath, f.Classes)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(path string, _, _ int) ([][4]float64, error) {
+			boxes, ok := labels[filepath.Base(path)]
+			if !ok {
+				return nil, fmt.Errorf("not in the COCO labels")
+			}
+			return boxes, nil
+		}, nil
+	}
+
+	labelsDir := f.LabelsPath
+	if labelsDir == "" {
+		labelsDir = f.DatasetPath
+		// The usual layout of a YOLO dataset is images/ and labels/ side by side.
+		sibling := filepath.Join(filepath.Dir(filepath.Clean(f.DatasetPath)), "labels")
+		if filepath.Base(filepath.Clean(f.DatasetPath)) == "images" {
+			if info, err := os.Stat(sibling); err == nil && info.IsDir() {
+				labelsDir = sibling
+			}
+		}
+	}
+
+	return func(path string, width, height int) ([][4]float64, error) {
+		return readYOLOLabels(yoloLabelsPath(labelsDir, path), width, height, f.Classes)
+	}, nil
+}
+
+func evaluateImage(ctx context.Context, detector *failureDetector, path string, labelsFor func(string, int, int) ([][4]float64, error)) ([]detectedFailure, [][4]float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bounds := img.Bounds()
+	labels, err := labelsFor(path, bounds.Dx(), bounds.Dy())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	failures, err := detector.detect(ctx, "", img)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return failures, labels, nil
+}
+
+func (f *failureDetectEvaluateCommand) evaluate(images []evaluationImage) evaluationReport {
+	report := evaluationReport{
+		Time:         time.Now(),
+		IoUThreshold: f.IoUThreshold,
+	}
+
+	for _, img := range images {
+		if img.err != nil {
+			report.Errors++
+			continue
+		}
+		report.Images++
+		report.Labels += len(img.labels)
+	}
+
+	thresholds := append([]float64(nil), f.Thresholds...)
+	sort.Float64s(thresholds)
+	for _, threshold := range thresholds {
+		result := evaluationResult{Threshold: threshold}
+		for _, img := range images {
+			if img.err != nil {
+				continue
+			}
+
+			tp, fp, fn := matchDetections(img.failures, img.labels, threshold, f.IoUThreshold)
+			result.Boxes.TP += tp
+			result.Boxes.FP += fp
+			result.Boxes.FN += fn
+
+			detected := tp+fp > 0
+			switch {
+			case detected && len(img.labels) > 0:
+				result.Frames.TP++
+			case detected:
+				result.Frames.FP++
+			case len(img.labels) > 0:
+				result.Frames.FN++
+			default:
+				result.Frames.TN++
+			}
+		}
+		result.Boxes.score()
+		result.Frames.score()
+
+		report.Results = append(report.Results, result)
+	}
+
+	for i, result := range report.Results {
+		if report.Best == nil || result.Boxes.F1 > report.Best.Boxes.F1 {
+			report.Best = &report.Results[i]
+		}
+	}
+
+	return report
+}
+
+// score sets the precision, recall and F1. Without detections the precision is 0, like without labels
+// the recall is.
+func (c *evaluationCounts) score() {
+	if c.TP+c.FP > 0 {
+		c.Precision = float64(c.TP) / float64(c.TP+c.FP)
+	}
+	if c.TP+c.FN > 0 {
+		c.Recall = float64(c.TP) / float64(c.TP+c.FN)
+	}
+	if c.Precision+c.Recall > 0 {
+		c.F1 = 2 * c.Precision * c.Recall / (c.Precision + c.Recall)
+	}
+}
+
+// matchDetections matches the detections with at least the confidence threshold to the labels, the most
+// confident first, each to the unmatched label it overlaps most with. It returns the matched detections,
+// the detections that didn't match a label and the labels that no detection matched.
+func matchDetections(failures []detectedFailure, labels [][4]float64, threshold, iouThreshold float64) (int, int, int) {
+	var detections []detectedFailure
+	for _, failure := range failures {
+		if failure.Confidence >= threshold {
+			detections = append(detections, failure)
+		}
+	}
+	sort.SliceStable(detections, func(i, j int) bool { return detections[i].Confidence > detections[j].Confidence })
+
+	matched := make([]bool, len(labels))
+	tp := 0
+	for _, detection := range detections {
+		best, bestIoU := -1, iouThreshold
+		for i, label := range labels {
+			if matched[i] {
+				continue
+			}
+			if overlap := boxIoU(detection.BoxCoordinates, label); overlap >= bestIoU {
+				best, bestIoU = i, overlap
+			}
+		}
+		if best >= 0 {
+			matched[best] = true
+			tp++
+		}
+	}
+
+	return tp, len(detections) - tp, len(labels) - tp
+}
+
+// boxIoU returns the intersection over union of two boxes given as center and size.
+func boxIoU(a, b [4]float64) float64 {
+	left := max(a[0]-a[2]/2, b[0]-b[2]/2)
+	right := min(a[0]+a[2]/2, b[0]+b[2]/2)
+	top := max(a[1]-a[3]/2, b[1]-b[3]/2)
+	bottom := min(a[1]+a[3]/2, b[1]+b[3]/2)
+	if right <= left || bottom <= top {
+		return 0
+	}
+
+	intersection := (right - left) * (bottom - top)
+	return intersection / (a[2]*a[3] + b[2]*b[3] - intersection)
+}
+
+func (f *failureDetectEvaluateCommand) printReport(w io.Writer, report evaluationReport) {
+	fmt.Fprintf(w, "evaluated %d images with %d labels, %d errors, IoU threshold %.2f\n", report.Images, report.Labels, report.Errors, report.IoUThreshold)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "threshold\tprecision\trecall\tf1\ttp\tfp\tfn\tframe precision\tframe recall\tframe f1")
+	for _, r := range report.Results {
+		fmt.Fprintf(tw, "%.2f\t%.3f\t%.3f\t%.3f\t%d\t%d\t%d\t%.3f\t%.3f\t%.3f\n",
+			r.Threshold, r.Boxes.Precision, r.Boxes.Recall, r.Boxes.F1, r.Boxes.TP, r.Boxes.FP, r.Boxes.FN,
+			r.Frames.Precision, r.Frames.Recall, r.Frames.F1)
+	}
+	tw.Flush()
+
+	if report.Best != nil {
+		fmt.Fprintf(w, "best threshold %.2f: precision %.3f, recall %.3f, f1 %.3f\n", report.Best.Threshold, report.Best.Boxes.Precision, report.Best.Boxes.Recall, report.Best.Boxes.F1)
+	}
+}
+
+func (f *failureDetectEvaluateCommand) writeReport(report evaluationReport) error {
+	out, err := os.Create(f.ReportPath)
+	if err != nil {
+		return err
+	}
+
+	if f.ReportFormat == "csv" {
+		err = writeEvaluationCSV(out, report.Results)
+	} else {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
+
+func writeEvaluationCSV(w io.Writer, results []evaluationResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"threshold", "tp", "fp", "fn", "precision", "recall", "f1", "frame_tp", "frame_fp", "frame_fn", "frame_tn", "frame_precision", "frame_recall", "frame_f1"})
+
+	float := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, r := range results {
+		cw.Write([]string{
+			float(r.Threshold),
+			strconv.Itoa(r.Boxes.TP), strconv.Itoa(r.Boxes.FP), strconv.Itoa(r.Boxes.FN),
+			float(r.Boxes.Precision), float(r.Boxes.Recall), float(r.Boxes.F1),
+			strconv.Itoa(r.Frames.TP), strconv.Itoa(r.Frames.FP), strconv.Itoa(r.Frames.FN), strconv.Itoa(r.Frames.TN),
+			float(r.Frames.Precision), float(r.Frames.Recall), float(r.Frames.F1),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -2,17 +2,18 @@ package cli
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"image"
-	"image/color"
 	"image/jpeg"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"sync"
 	"time"
 
-	"github.com/fogleman/gg"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -26,48 +27,127 @@ var (
 			Help:      "A histogram of request latencies to the ML API.",
 			Buckets:   prometheus.DefBuckets,
 		},
-		[]string{"code", "method"},
+		[]string{"code", "method", "printer"},
 	)
 
-	mlAPILastFailuresCount = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "prusalgtm",
-		Name:      "mlapi_last_failures_count",
-		Help:      "The number of failures detected in the last request to the ML API.",
-	})
-	mlAPILastCallSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
-		Namespace: "prusalgtm",
-		Name:      "mlapi_last_call_success_timestamp_seconds",
-		Help:      "The timestamp of the last successful call to the ML API.",
-	})
-
-	mlAPIRoundTripper = promhttp.InstrumentRoundTripperDuration(mlAPIDurationHistogram, http.DefaultTransport)
+	mlAPILastFailuresCount = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "mlapi_last_failures_count",
+			Help:      "The number of failures detected in the last request to the ML API.",
+		},
+		[]string{"printer"},
+	)
+	mlAPILastCallSuccessTimestamp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "mlapi_last_call_success_timestamp_seconds",
+			Help:      "The timestamp of the last successful call to the ML API.",
+		},
+		[]string{"printer"},
+	)
+	mlAPIRetries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "mlapi_retries_total",
+			Help:      "The number of retried requests to the ML API.",
+		},
+		[]string{"printer"},
+	)
+	mlAPIBreakerOpen = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "mlapi_circuit_breaker_open",
+			Help:      "1 if the ML API is considered down and frames are not sent to it, 0 otherwise.",
+		},
+		[]string{"printer"},
+	)
 )
 
+type MLClientConfig struct {
+	Timeout         time.Duration `kong:"help='The timeout of a single request to the ML API.',default='30s',name='ml-api-timeout'"`
+	Retries         int           `kong:"help='The number of times to retry a request to the ML API that failed with a network error or a 5xx.',default='2',name='ml-api-retries'"`
+	RetryBackoff    time.Duration `kong:"help='The wait before the first retry, doubled for every retry after it.',default='1s',name='ml-api-retry-backoff'"`
+	BreakerFailures int           `kong:"help='Stop sending frames to the ML API after this many failed calls in a row. 0 disables it.',default='5',name='ml-api-breaker-failures'"`
+	BreakerCooldown time.Duration `kong:"help='How long to wait before sending a frame to the ML API again after it was stopped.',default='1m',name='ml-api-breaker-cooldown'"`
+
+	Protocol  string `kong:"help='The protocol of the ML API. prusalgtm posts the frame to /predict, obico has the ML API fetch the frame from prusaLGTM with GET /p/.',default='prusalgtm',enum='prusalgtm,obico',name='ml-api-protocol'"`
+	FrameURL  string `kong:"help='The URL the ML API can reach the Prometheus port of prusaLGTM at, to fetch the frames with --ml-api-protocol=obico.',optional,name='ml-api-frame-url'"`
+	Token     string `kong:"help='The token of the ML API, sent as a bearer token, eg. the ML_API_TOKEN of Obico.',optional,name='ml-api-token',env='PRUSALGTM_ML_API_TOKEN'"`
+	TokenFile string `kong:"help='A file with the token of the ML API.',optional,name='ml-api-token-file',type='path'"`
+	Decoder   string `kong:"help='How to decode the responses of the ML API. loose skips the detections it can not make sense of, strict fails the whole response.',default='loose',enum='loose,strict',name='ml-api-decoder'"`
+}
+
+// errMLAPIUnavailable is returned without calling the ML API while the circuit breaker is open.
+var errMLAPIUnavailable = errors.New("the ML API is unavailable, not sending frames until the cooldown is over")
+
+// failureDetectCommand has the ML API and detection settings of its subcommands. Running it without a
+// subcommand detects failures in images.
 type failureDetectCommand struct {
-	MLAPIURL string `kong:"help='The URL to the ML API to detect failures.',required,name='ml-api-url'"`
+	MLAPIURL string `kong:"help='The URL to the ML API to detect failures.',optional,name='ml-api-url'"`
+	MLClientConfig
+	HeuristicConfig
+	DetectionConfig
+
+	Images   failureDetectImagesCommand   `cmd:"images" default:"withargs" help:"Detect failures in images, or in the frames logged to Loki. This is the default."`
+	Evaluate failureDetectEvaluateCommand `cmd:"evaluate" help:"Evaluate the detector against images labelled with their failures."`
+}
+
+func (f *failureDetectCommand) newDetector() (*failureDetector, error) {
+	return newFailureDetector(f.MLAPIURL, f.MLClientConfig, f.HeuristicConfig, f.DetectionConfig, newLogger("", ""))
+}
 
-	ImagePath  string `kong:"help='The path to the image to detect failures in.',required,name='image-path',type='existingfile'"`
-	OutputPath string `kong:"help='The path to save the image with the detected failures.',name='output-path',type='string'"`
+type failureDetectImagesCommand struct {
+	ImagePaths []string `kong:"help='The image to detect failures in, or a directory or glob of JPEGs. Can be repeated.',optional,sep='none',name='image-path'"`
+	OutputPath string   `kong:"help='The path to save the image with the detected failures, for a single image.',name='output-path',type='string'"`
+	DebugZones bool     `kong:"help='Also draw the detection zones on the output images.',name='debug-zones'"`
+
+	// The frames logged by print-image, like generate-timelapse.
+	LokiURL          string    `kong:"help='The URL to the Loki API to fetch the logged frames from.',optional,name='loki-url'"`
+	LokiUsername     string    `kong:"help='The username to authenticate with the Loki API.',optional,name='loki-username'"`
+	LokiPassword     string    `kong:"help='The password to authenticate with the Loki API.',optional,name='loki-password',env='PRUSALGTM_LOKI_PASSWORD'"`
+	LokiPasswordFile string    `kong:"help='A file with the password to authenticate with the Loki API.',optional,name='loki-password-file',type='path'"`
+	LogQLQuery       string    `kong:"help='The LogQL query to fetch the frames.',default='{unit=\"prusaLGTM.service\"} |= \"base64\"',name='logql-query'"`
+	StartTime        time.Time `kong:"help='The start time of the frames to fetch from Loki.',optional,name='start-time'"`
+	EndTime          time.Time `kong:"help='The end time of the frames to fetch from Loki.',optional,name='end-time'"`
+
+	ReportPath   string `kong:"help='Write the detections in every frame to this file.',optional,name='report-path',type='path'"`
+	ReportFormat string `kong:"help='The format of the report. json also has the timeline of the failure score.',default='csv',enum='csv,json',name='report-format'"`
+	OutputDir    string `kong:"help='Write the frames with failures, with the failures drawn on them, to this directory.',optional,name='output-dir',type='path'"`
+	Concurrency  int    `kong:"help='The number of frames sent to the ML API at once.',default='4',name='concurrency'"`
+
+	DatasetExportConfig
 }
 
-func (f *failureDetectCommand) Run() error {
-	detector, err := newFailureDetector(f.MLAPIURL)
+func (f *failureDetectImagesCommand) Run(ctx context.Context, parent *failureDetectCommand) error {
+	if len(f.ImagePaths) == 0 && f.LokiURL == "" {
+		return fmt.Errorf("failure-detect requires --image-path or --loki-url")
+	}
+	// The heuristics learn the print from the first frames of a camera, they find nothing in a single frame.
+	if parent.Detector == detectorHeuristic && !f.isBatch() {
+		return fmt.Errorf("--detector=heuristic needs the frames of a camera in order, pass a directory or glob of frames with --image-path, or --loki-url")
+	}
+
+	detector, err := parent.newDetector()
 	if err != nil {
 		return err
 	}
 
-	file, err := os.Open(f.ImagePath)
+	if f.isBatch() {
+		return f.runBatch(ctx, detector, parent.DetectionConfig)
+	}
+
+	data, err := os.ReadFile(f.ImagePaths[0])
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	img, err := jpeg.Decode(file)
+	img, err := jpeg.Decode(bytes.NewReader(data))
 	if err != nil {
 		return err
 	}
 
-	image_with_failures, failures, err := detector.DetectFailure(img)
+	image_with_failures, failures, err := detector.DetectFailure(ctx, "", img)
 	if err != nil {
 		return err
 	}
@@ -76,10 +156,27 @@ func (f *failureDetectCommand) Run() error {
 		fmt.Printf("Failure detected with confidence %f at coordinates %v\n", failure.Confidence, failure.BoxCoordinates)
 	}
 
+	exporter, err := newDatasetExporter(f.DatasetExportConfig)
+	if err != nil {
+		return err
+	}
+	if exporter != nil {
+		if err := exporter.add(batchFrame{source: f.ImagePaths[0]}.name(), img, data, failures); err != nil {
+			return err
+		}
+		if err := exporter.flush(); err != nil {
+			return err
+		}
+	}
+
 	if f.OutputPath == "" {
 		return nil
 	}
 
+	if f.DebugZones {
+		image_with_failures = detector.zones.draw(image_with_failures)
+	}
+
 	outputFile, err := os.Create(f.OutputPath)
 	if err != nil {
 		return err
@@ -91,94 +188,343 @@ func (f *failureDetectCommand) Run() error {
 	return outputFile.Close()
 }
 
+// failureDetector is the client of the ML API. It has its own HTTP client, so the connections to the ML
+// API are reused between frames, and a circuit breaker that stops sending frames while the ML API is down.
 type failureDetector struct {
 	MLAPIURL *url.URL
+	// frameURL is where the ML API fetches the frames from, with the obico protocol.
+	frameURL *url.URL
+	token    string
+
+	cfg          MLClientConfig
+	detectionCfg DetectionConfig
+	zones        detectionZones
+	overlay      *overlay
+	client       *http.Client
+	log          logger
+
+	// heuristics detect the failures instead of the ML API with --detector=heuristic.
+	heuristics *heuristicDetector
+
+	// The result of the last call, for health checks and the circuit breaker. The cameras of a printer
+	// share the detector.
+	resultMtx   sync.Mutex
+	lastSuccess time.Time
+	lastErr     error
+	failedCalls int
+	// breakerUntil is when the next frame is sent after the breaker opened, zero while it's closed.
+	breakerUntil time.Time
+	// probing is true while the call after the cooldown is in flight, the other frames are skipped until
+	// it returns.
+	probing bool
 }
 
-func newFailureDetector(mlAPIURL string) (*failureDetector, error) {
+func newFailureDetector(mlAPIURL string, cfg MLClientConfig, heuristicCfg HeuristicConfig, detectionCfg DetectionConfig, log logger) (*failureDetector, error) {
+	if heuristicCfg.Detector == detectorHeuristic {
+		return &failureDetector{
+			detectionCfg: detectionCfg,
+			zones:        detectionCfg.zones(),
+			overlay:      &overlay{detectionCfg: detectionCfg},
+			heuristics:   newHeuristicDetector(heuristicCfg),
+			log:          log,
+		}, nil
+	}
+	if mlAPIURL == "" {
+		return nil, fmt.Errorf("--ml-api-url is required, or --detector=heuristic")
+	}
+
 	parsedURL, err := url.Parse(mlAPIURL)
 	if err != nil {
 		return nil, err
 	}
 
+	predictURL := parsedURL.JoinPath("/predict")
+	var frameURL *url.URL
+	if cfg.Protocol == mlProtocolObico {
+		if cfg.FrameURL == "" {
+			return nil, fmt.Errorf("--ml-api-protocol=obico requires --ml-api-frame-url")
+		}
+		frameURL, err = url.Parse(cfg.FrameURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --ml-api-frame-url: %w", err)
+		}
+		predictURL = parsedURL.JoinPath("/p/")
+	}
+
+	token, err := readSecret(cfg.Token, cfg.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	durations := mlAPIDurationHistogram.MustCurryWith(prometheus.Labels{"printer": log.printer})
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Every camera of the printer can have a request in flight.
+	transport.MaxIdleConnsPerHost = 8
+
+	mlAPIBreakerOpen.WithLabelValues(log.printer).Set(0)
+
 	return &failureDetector{
-		MLAPIURL: parsedURL.JoinPath("/predict"),
+		MLAPIURL:     predictURL,
+		frameURL:     frameURL,
+		token:        token,
+		cfg:          cfg,
+		detectionCfg: detectionCfg,
+		zones:        detectionCfg.zones(),
+		overlay:      &overlay{detectionCfg: detectionCfg},
+		client: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: promhttp.InstrumentRoundTripperDuration(durations, transport),
+		},
+		log: log,
 	}, nil
 }
 
-func (f *failureDetector) DetectFailure(img image.Image) (image.Image, []detectedFailure, error) {
-	buf := bytes.NewBuffer(nil)
-	jpeg.Encode(buf, img, &jpeg.Options{Quality: 100})
+// DetectFailure returns the failures in the frame of the camera, and the frame with them drawn on it.
+func (f *failureDetector) DetectFailure(ctx context.Context, camera string, img image.Image) (image.Image, []detectedFailure, error) {
+	failures, err := f.detect(ctx, camera, img)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return f.overlay.draw(img, 0, failures, time.Now()), failures, nil
+}
+
+// detect returns the failures in the frame of the camera, for the callers that draw them on their own. The
+// heuristics need the frames of a camera in order.
+func (f *failureDetector) detect(ctx context.Context, camera string, img image.Image) ([]detectedFailure, error) {
+	if f.heuristics != nil {
+		bounds := img.Bounds()
+		return f.dropNoise(f.heuristics.detect(camera, img, time.Now()), bounds.Dx(), bounds.Dy()), nil
+	}
 
-	client := http.DefaultClient
-	client.Timeout = 500 * time.Second
-	client.Transport = mlAPIRoundTripper
+	if !f.allow() {
+		return nil, errMLAPIUnavailable
+	}
+
+	failures, err := f.detectFailure(ctx, img)
+	f.record(ctx, err)
+
+	return failures, err
+}
+
+// setPrinterStatus gives the overlays and the heuristics the state of the printer.
+func (f *failureDetector) setPrinterStatus(status func() (printerState, *printerStatus)) {
+	f.overlay.status = status
+	if f.heuristics != nil {
+		f.heuristics.status = status
+	}
+}
+
+// dropNoise drops the detections below the thresholds or in the excluded zones, before anything sees them.
+func (f *failureDetector) dropNoise(failures []detectedFailure, width, height int) []detectedFailure {
+	return f.zones.filter(f.detectionCfg.filter(failures, width, height))
+}
+
+// allow returns false while the circuit breaker is open. Once the cooldown is over, it lets a single call
+// through to check if the ML API is back.
+func (f *failureDetector) allow() bool {
+	f.resultMtx.Lock()
+	defer f.resultMtx.Unlock()
+
+	if f.breakerUntil.IsZero() {
+		return true
+	}
+	if f.probing || time.Now().Before(f.breakerUntil) {
+		return false
+	}
+
+	f.probing = true
+	return true
+}
+
+// record records the result of a call and opens or closes the circuit breaker.
+func (f *failureDetector) record(ctx context.Context, err error) {
+	f.resultMtx.Lock()
+	defer f.resultMtx.Unlock()
+
+	f.probing = false
+	// A cancelled call says nothing about the ML API.
+	if ctx.Err() != nil {
+		return
+	}
+
+	f.lastErr = err
+	if err == nil {
+		if !f.breakerUntil.IsZero() {
+			f.log.Println("the ML API is back, sending frames again")
+		}
+		f.lastSuccess = time.Now()
+		f.failedCalls = 0
+		f.breakerUntil = time.Time{}
+		mlAPIBreakerOpen.WithLabelValues(f.log.printer).Set(0)
+		return
+	}
+
+	f.failedCalls++
+	if f.cfg.BreakerFailures > 0 && f.failedCalls >= f.cfg.BreakerFailures {
+		if f.breakerUntil.IsZero() {
+			f.log.Printf("the ML API failed %d calls in a row, not sending frames for %s: %v\n", f.failedCalls, f.cfg.BreakerCooldown, err)
+		}
+		f.breakerUntil = time.Now().Add(f.cfg.BreakerCooldown)
+		mlAPIBreakerOpen.WithLabelValues(f.log.printer).Set(1)
+	}
+}
+
+// lastResult returns when the ML API last succeeded and the error of the last call, if it failed.
+func (f *failureDetector) lastResult() (time.Time, error) {
+	f.resultMtx.Lock()
+	defer f.resultMtx.Unlock()
+
+	return f.lastSuccess, f.lastErr
+}
+
+// breakerOpen returns true if frames are not sent to the ML API.
+func (f *failureDetector) breakerOpen() bool {
+	f.resultMtx.Lock()
+	defer f.resultMtx.Unlock()
+
+	return !f.breakerUntil.IsZero()
+}
+
+// retryableError is an error of a request that can succeed if it's sent again.
+type retryableError struct {
+	err error
+}
+
+func (e retryableError) Error() string { return e.err.Error() }
+func (e retryableError) Unwrap() error { return e.err }
+
+// predict sends the JPEG to the ML API and returns the response, retrying network errors and 5xx with
+// exponential backoff.
+func (f *failureDetector) predict(ctx context.Context, frame []byte) ([]byte, error) {
+	backoff := f.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := f.predictOnce(ctx, frame)
+		var retryable retryableError
+		if err == nil || !errors.As(err, &retryable) || attempt >= f.cfg.Retries || ctx.Err() != nil {
+			return resp, err
+		}
+
+		f.log.Printf("ML API request failed, retrying in %s: %v\n", backoff, err)
+		mlAPIRetries.WithLabelValues(f.log.printer).Inc()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (f *failureDetector) predictOnce(ctx context.Context, frame []byte) ([]byte, error) {
+	req, done, err := f.newRequest(ctx, frame)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
 	start := time.Now()
-	resp, err := client.Post(f.MLAPIURL.String(), "image/jpeg", bytes.NewReader(buf.Bytes()))
+	resp, err := f.client.Do(req)
 	if err != nil {
-		return nil, nil, err
+		return nil, retryableError{err}
 	}
 	defer resp.Body.Close()
-	fmt.Println("ML API request took", time.Since(start))
+	// The connection is only reused if the body was read to the end.
+	defer io.Copy(io.Discard, resp.Body)
+	f.log.Println("ML API request took", time.Since(start))
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, nil, fmt.Errorf("expected status code 200, got %d", resp.StatusCode)
+		err := fmt.Errorf("expected status code 200, got %d", resp.StatusCode)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return nil, retryableError{err}
+		}
+		return nil, err
 	}
 
-	var detectionResponse detectionResponse
-
-	if err := json.NewDecoder(resp.Body).Decode(&detectionResponse); err != nil {
-		return nil, nil, err
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, retryableError{err}
 	}
 
-	failures := make([]detectedFailure, 0, len(detectionResponse.Detections))
-	for _, detection := range detectionResponse.Detections {
-		confidence, ok := detection[1].(float64)
-		if !ok {
-			return nil, nil, fmt.Errorf("expected confidence to be a float64, got %T", detection[1])
+	return body, nil
+}
+
+// newRequest returns the request for the frame in the protocol of the ML API, and a function to call once
+// the response is read.
+func (f *failureDetector) newRequest(ctx context.Context, frame []byte) (*http.Request, func(), error) {
+	var (
+		req  *http.Request
+		done = func() {}
+		err  error
+	)
+	switch f.cfg.Protocol {
+	case mlProtocolObico:
+		var name string
+		name, done, err = mlAPIFrames.add(frame)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		boxCoordinates, ok := detection[2].([]interface{})
-		if !ok {
-			return nil, nil, fmt.Errorf("expected box coordinates to be a []float64, got %T", detection[2])
+		predictURL := *f.MLAPIURL
+		predictURL.RawQuery = url.Values{"img": {f.frameURL.JoinPath(mlAPIFramesPath, name+".jpg").String()}}.Encode()
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, predictURL.String(), nil)
+	default:
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, f.MLAPIURL.String(), bytes.NewReader(frame))
+		if err == nil {
+			req.Header.Set("Content-Type", "image/jpeg")
 		}
+	}
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
 
-		failures = append(failures, detectedFailure{
-			Confidence:     confidence,
-			BoxCoordinates: [4]float64{boxCoordinates[0].(float64), boxCoordinates[1].(float64), boxCoordinates[2].(float64), boxCoordinates[3].(float64)},
-		})
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
 	}
 
-	mlAPILastCallSuccessTimestamp.SetToCurrentTime()
-	mlAPILastFailuresCount.Set(float64(len(failures)))
+	return req, done, nil
+}
 
-	if len(failures) == 0 {
-		return img, failures, nil
+func (f *failureDetector) detectFailure(ctx context.Context, img image.Image) ([]detectedFailure, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		return nil, err
 	}
 
-	ggCtx := gg.NewContextForImage(img)
-	ggCtx.SetColor(color.RGBA{255, 0, 0, 255})
-	ggCtx.SetLineWidth(2)
-	for _, failure := range failures {
-		// It's the x, y (of the center of the box), width, height
-		xc := failure.BoxCoordinates[0]
-		yc := failure.BoxCoordinates[1]
-		w := failure.BoxCoordinates[2]
-		h := failure.BoxCoordinates[3]
+	body, err := f.predict(ctx, buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
 
-		ggCtx.DrawRectangle(xc-(w/2), yc-(h/2), w, h)
-		ggCtx.Stroke()
+	bounds := img.Bounds()
+	failures, err := f.decodeDetections(body, bounds.Dx(), bounds.Dy())
+	if err != nil {
+		return nil, err
 	}
 
-	return ggCtx.Image(), failures, nil
-}
+	failures = f.dropNoise(failures, bounds.Dx(), bounds.Dy())
+
+	mlAPILastCallSuccessTimestamp.WithLabelValues(f.log.printer).SetToCurrentTime()
+	mlAPILastFailuresCount.WithLabelValues(f.log.printer).Set(float64(len(failures)))
 
-type detectionResponse struct {
-	Detections [][]any `json:"detections"`
+	return failures, nil
 }
 
 type detectedFailure struct {
-	Confidence     float64
-	BoxCoordinates [4]float64
+	// Label is the class of the failure as the ML API reported it.
+	Label      string  `json:"label,omitempty"`
+	Confidence float64 `json:"confidence"`
+	// BoxCoordinates are the x, y of the center of the box, its width and height.
+	BoxCoordinates [4]float64 `json:"box"`
+}
+
+// label returns the class of the failure, or failure if the ML API didn't name it.
+func (d detectedFailure) label() string {
+	if d.Label == "" {
+		return failureClass
+	}
+	return d.Label
 }
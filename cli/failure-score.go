@@ -0,0 +1,168 @@
+package cli
+
+import (
+	"image/color"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promFailureScore = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "failure_score",
+			Help:      "The smoothed failure score of the current job.",
+		},
+		[]string{"printer", "camera"},
+	)
+	promFailureLevel = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "failure_level",
+			Help:      "The level of the failure score of the current job. 0 is ok, 1 is warning and 2 is critical.",
+		},
+		[]string{"printer", "camera"},
+	)
+)
+
+type DetectionConfig struct {
+	MinConfidence     float64 `kong:"help='Ignore detections with a lower confidence. They are not drawn and do not count towards anything.',default='0.2',name='detect-min-confidence'"`
+	MinBoxArea        float64 `kong:"help='Ignore detections with a box smaller than this fraction of the frame.',default='0.0001',name='detect-min-box-area'"`
+	ScoreSpan         int     `kong:"help='The number of frames the failure score is smoothed over.',default='12',name='detect-score-span'"`
+	WarningThreshold  float64 `kong:"help='The failure score, or the confidence of a single detection, at which the failure is a warning.',default='0.38',name='detect-warning-threshold'"`
+	CriticalThreshold float64 `kong:"help='The failure score, or the confidence of a single detection, at which the failure is critical.',default='0.78',name='detect-critical-threshold'"`
+
+	// The zones are in the coordinates of the frames sent to the ML API, the full camera resolution.
+	ExcludeZones []detectionZone `kong:"help='A polygon of the frame, as space separated x,y points, where detections are ignored, eg. the purge line. Can be repeated.',optional,sep='none',name='detect-exclude-zone'"`
+	IncludeZones []detectionZone `kong:"help='A polygon of the frame, as space separated x,y points, outside of which detections are ignored, eg. the bed. Can be repeated.',optional,sep='none',name='detect-include-zone'"`
+	ZoneOverlap  float64         `kong:"help='Ignore a detection when at least this fraction of its box is excluded by the zones.',default='0.5',name='detect-zone-overlap'"`
+
+	OverlayLabels bool `kong:"help='Write the class and confidence of every detection next to its box.',default='true',negatable,name='overlay-labels'"`
+}
+
+type failureLevel int
+
+const (
+	levelOK failureLevel = iota
+	levelWarning
+	levelCritical
+)
+
+func (l failureLevel) String() string {
+	switch l {
+	case levelWarning:
+		return "warning"
+	case levelCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+// color is the color of the boxes of the detections at the level.
+func (l failureLevel) color() color.Color {
+	switch l {
+	case levelWarning:
+		return color.RGBA{255, 140, 0, 255}
+	case levelCritical:
+		return color.RGBA{255, 0, 0, 255}
+	}
+	return color.RGBA{255, 220, 0, 255}
+}
+
+func (cfg DetectionConfig) level(score float64) failureLevel {
+	switch {
+	case score >= cfg.CriticalThreshold:
+		return levelCritical
+	case score >= cfg.WarningThreshold:
+		return levelWarning
+	}
+	return levelOK
+}
+
+// filter returns the failures that are confident and large enough, in a frame of the given size.
+func (cfg DetectionConfig) filter(failures []detectedFailure, width, height int) []detectedFailure {
+	minArea := cfg.MinBoxArea * float64(width*height)
+
+	filtered := make([]detectedFailure, 0, len(failures))
+	for _, failure := range failures {
+		if failure.Confidence < cfg.MinConfidence {
+			continue
+		}
+		if failure.BoxCoordinates[2]*failure.BoxCoordinates[3] < minArea {
+			continue
+		}
+		filtered = append(filtered, failure)
+	}
+
+	return filtered
+}
+
+func (cfg DetectionConfig) zones() detectionZones {
+	return detectionZones{
+		include: cfg.IncludeZones,
+		exclude: cfg.ExcludeZones,
+		overlap: cfg.ZoneOverlap,
+	}
+}
+
+// failureScore is the failure score of a camera during a job, like Obico's: an exponentially weighted
+// moving average of the sum of the confidences of the detections in each frame. A single noisy frame
+// barely moves it, a failure that stays in view pushes it up within a few frames.
+type failureScore struct {
+	cfg DetectionConfig
+	log logger
+
+	mtx   sync.Mutex
+	score float64
+	level failureLevel
+}
+
+func newFailureScore(cfg DetectionConfig, log logger) *failureScore {
+	s := &failureScore{cfg: cfg, log: log}
+	s.reset()
+	return s
+}
+
+// observe adds the failures of a frame to the score, and returns the new score and level and the level
+// before the frame.
+func (s *failureScore) observe(failures []detectedFailure) (float64, failureLevel, failureLevel) {
+	frameScore := 0.0
+	for _, failure := range failures {
+		frameScore += failure.Confidence
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	alpha := 2 / (float64(max(s.cfg.ScoreSpan, 1)) + 1)
+	s.score = alpha*frameScore + (1-alpha)*s.score
+
+	previous := s.level
+	s.level = s.cfg.level(s.score)
+
+	promFailureScore.WithLabelValues(s.log.printer, s.log.camera).Set(s.score)
+	promFailureLevel.WithLabelValues(s.log.printer, s.log.camera).Set(float64(s.level))
+
+	return s.score, s.level, previous
+}
+
+// current returns the score and level, without a new frame.
+func (s *failureScore) current() (float64, failureLevel) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.score, s.level
+}
+
+// reset starts the score of a new job.
+func (s *failureScore) reset() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.score = 0
+	s.level = levelOK
+	promFailureScore.WithLabelValues(s.log.printer, s.log.camera).Set(0)
+	promFailureLevel.WithLabelValues(s.log.printer, s.log.camera).Set(0)
+}
@@ -0,0 +1,189 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promFarmPipelineUp = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "farm_pipeline_up",
+			Help:      "1 if the pipeline of the printer is running, 0 while it waits to be restarted.",
+		},
+		[]string{"printer"},
+	)
+	promFarmPipelineRestarts = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "farm_pipeline_restarts_total",
+			Help:      "The number of times the pipeline of the printer was restarted after it failed.",
+		},
+		[]string{"printer"},
+	)
+)
+
+// farmCommand runs the print-image pipeline of every printer in the config file in a single process. Each
+// printer section is parsed as if it was passed to print-image with --printer.
+type farmCommand struct {
+	RestartDelay time.Duration `kong:"help='How long to wait before restarting the pipeline of a printer that failed.',default='30s',name='farm-restart-delay'"`
+}
+
+func (f *farmCommand) Run(ctx context.Context) error {
+	if PrusaLGTM.ConfigFile == "" {
+		return fmt.Errorf("farm requires --config-file with a printers section")
+	}
+
+	cfg, err := loadConfigFile(string(PrusaLGTM.ConfigFile))
+	if err != nil {
+		return err
+	}
+
+	names := cfg.printerNames()
+	if len(names) == 0 {
+		return fmt.Errorf("no printers in %s", PrusaLGTM.ConfigFile)
+	}
+
+	// Parse every printer before starting any, so that a typo doesn't leave the farm half running.
+	printers := make([]*printImage, 0, len(names))
+	cameras := make(map[string][]namedCamera, len(names))
+	for _, name := range names {
+		p, err := cfg.parsePrintImage(name, "")
+		if err != nil {
+			return err
+		}
+		p.live = newLiveConfig(p.liveSettings())
+		p.log = newLogger(name, "")
+
+		cameras[name], err = cfg.printerCameras(name, p.namedCamera())
+		if err != nil {
+			return err
+		}
+
+		printers = append(printers, p)
+	}
+
+	reloadCtx, stopReloading := context.WithCancel(ctx)
+	defer stopReloading()
+	go reloadOnSIGHUP(reloadCtx, func() error {
+		return reloadFarm(printers)
+	})
+
+	var wg sync.WaitGroup
+	for _, p := range printers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f.supervise(ctx, p, cameras[p.PrinterName])
+		}()
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// supervise runs the pipeline of the printer and restarts it after RestartDelay whenever it stops, without
+// affecting the other printers, until ctx is done.
+func (f *farmCommand) supervise(ctx context.Context, p *printImage, cameras []namedCamera) {
+	var (
+		mtx      sync.Mutex
+		running  bool
+		restarts int
+		lastErr  error
+	)
+	defer healthChecks.add(func() componentHealth {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		health := componentHealth{
+			Component: "pipeline",
+			Printer:   p.PrinterName,
+			Healthy:   true,
+			Ready:     running,
+			Details:   map[string]any{"running": running, "restarts": restarts},
+		}
+		if lastErr != nil {
+			health.Details["last_error"] = lastErr.Error()
+		}
+		if !running {
+			health.Message = "the pipeline is waiting to be restarted"
+		}
+
+		return health
+	})()
+	setRunning := func(r bool, err error) {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		running = r
+		if !r {
+			lastErr = err
+		}
+	}
+
+	for {
+		p.log.Println("starting pipeline")
+		promFarmPipelineUp.WithLabelValues(p.PrinterName).Set(1)
+		setRunning(true, nil)
+
+		err := p.run(ctx, cameras)
+
+		promFarmPipelineUp.WithLabelValues(p.PrinterName).Set(0)
+		setRunning(false, err)
+		if ctx.Err() != nil {
+			p.log.Println("pipeline stopped")
+			return
+		}
+		if err != nil {
+			p.log.Printf("pipeline failed: %v. Restarting in %s\n", err, f.RestartDelay)
+		} else {
+			p.log.Printf("pipeline stopped. Restarting in %s\n", f.RestartDelay)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.RestartDelay):
+		}
+		promFarmPipelineRestarts.WithLabelValues(p.PrinterName).Inc()
+		mtx.Lock()
+		restarts++
+		mtx.Unlock()
+	}
+}
+
+// reloadFarm applies the live settings of every running printer from the config file. Adding or removing
+// printers needs a restart.
+func reloadFarm(printers []*printImage) error {
+	// This checks the file for unknown settings.
+	if _, err := reloadConfig(); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfigFile(string(PrusaLGTM.ConfigFile))
+	if err != nil {
+		return err
+	}
+
+	// Parse everything first, so a bad file doesn't apply to only some of the printers.
+	settings := make([]liveSettings, 0, len(printers))
+	for _, p := range printers {
+		reloaded, err := cfg.parsePrintImage(p.PrinterName, "")
+		if err != nil {
+			return err
+		}
+		settings = append(settings, reloaded.liveSettings())
+	}
+
+	for i, p := range printers {
+		p.live.set(settings[i])
+	}
+
+	return nil
+}
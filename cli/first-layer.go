@@ -0,0 +1,415 @@
+package cli
+
+import (
+	"image"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promFirstLayerInspections = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "first_layer_inspections_total",
+			Help:      "The number of first layers inspected, by result.",
+		},
+		[]string{"result", "printer", "camera"},
+	)
+	promFirstLayerDefects = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "first_layer_defects",
+			Help:      "The number of defects found in the last inspection of the first layer, by type.",
+		},
+		[]string{"defect", "printer", "camera"},
+	)
+)
+
+type FirstLayerConfig struct {
+	Enabled         bool          `kong:"help='Inspect the first layer against the empty bed at the start of the job, and draw the gaps, blobs and detached lines on the frames. Needs a printer that reports the Z height, not the detector.',default='false',name='first-layer-inspect'"`
+	Interval        time.Duration `kong:"help='Capture a frame this often during the first layer, on top of the capture interval.',default='10s',name='first-layer-interval'"`
+	ChangeThreshold float64       `kong:"help='The difference in brightness, from 0 to 1, from the empty bed at which a part of the bed has filament on it.',default='0.1',name='first-layer-change-threshold'"`
+	MinDefectArea   float64       `kong:"help='The smallest defect, as a fraction of the bed, that is reported.',default='0.0005',name='first-layer-min-defect-area'"`
+	MaxGapArea      float64       `kong:"help='The largest gap, as a fraction of the bed, that is reported. Larger holes in the layer are taken to be in the model.',default='0.002',name='first-layer-max-gap-area'"`
+	Pause           bool          `kong:"help='Pause the job when the first layer fails the inspection, even without --auto-pause.',default='false',name='first-layer-pause'"`
+}
+
+const (
+	defectGap      = "gap"
+	defectBlob     = "blob"
+	defectDetached = "detached line"
+
+	// firstLayerWidth is the width the bed is scaled down to. The bed is cropped out of the frame first, so
+	// it's inspected at a higher resolution than the heuristics look at the whole frame.
+	firstLayerWidth = 320
+)
+
+// firstLayerInspector inspects the first layer of every job on a camera. The first frame of a job is the
+// empty bed, and the frames while the Z height is at most --first-layer-height are compared to it:
+//
+//   - Filament is where the bed changed. Where it's there in two inspections in a row it's laid down, the
+//     print head doesn't stay in the same place that long.
+//   - A blob is laid down filament that is much more different from the bed than the rest of the layer,
+//     like a lump of plastic.
+//   - A detached line is laid down filament that is gone again, dragged away by the nozzle.
+//   - A gap is a small hole in a part of the laid down filament. Gaps are only looked for in the first
+//     frame after the layer is done, and the inspection of that frame decides if the layer failed.
+//
+// The layer is done when the Z height is above the first layer in two polls in a row, like a layer change,
+// so that a Z hop during a travel move doesn't end it.
+//
+// The bed is the --detect-include-zone zones, or the whole frame, minus the --detect-exclude-zone zones.
+type firstLayerInspector struct {
+	cfg   FirstLayerConfig
+	zones detectionZones
+	// policy returns the capture policy, which has the height of the first layer. It can change on SIGHUP.
+	policy func() CapturePolicyConfig
+	status func() (printerState, *printerStatus)
+	log    logger
+
+	mtx sync.Mutex
+	job string
+	// bed is the part of the frame the grid covers, and scale the size of a cell in the frame.
+	bed   image.Rectangle
+	scale float64
+	// width and height are the size of the grid, and inBed has the cells that are on the bed.
+	width, height int
+	inBed         []bool
+	reference     []float64
+	filament      []bool
+	laid          []bool
+	inspected     bool
+	done          bool
+	lastTrigger   time.Time
+	// lastStatus and previousZ are the last poll seen and its Z height. printedFirstLayer is set once a poll
+	// is in the first layer, and layerDone once the Z height is above it in two polls in a row after that.
+	lastStatus        *printerStatus
+	previousZ         float64
+	printedFirstLayer bool
+	layerDone         bool
+}
+
+// newFirstLayerInspector returns nil if the first layer isn't inspected.
+func newFirstLayerInspector(cfg FirstLayerConfig, detectionCfg DetectionConfig, policy func() CapturePolicyConfig, status func() (printerState, *printerStatus), log logger) *firstLayerInspector {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	return &firstLayerInspector{
+		cfg:    cfg,
+		zones:  detectionCfg.zones(),
+		policy: policy,
+		status: status,
+		log:    log,
+	}
+}
+
+// inFirstLayer returns true while the Z height is in the first layer of a job.
+func (i *firstLayerInspector) inFirstLayer(state printerState, status *printerStatus) bool {
+	return state == statePrinting && i.policy().inFirstLayer(status)
+}
+
+// wantsFrames returns true while the inspector needs the frames of the camera: from the empty bed at the
+// start of a job until the first layer is checked as a whole. The frames go to the inspector whether or not
+// the detector runs on them.
+func (i *firstLayerInspector) wantsFrames() bool {
+	state, status := i.status()
+	if state != statePrinting || status == nil || !status.HasAxisZ {
+		return false
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	return status.JobID != i.job || i.reference == nil || !i.done
+}
+
+// shouldTrigger returns true when a frame should be captured for the inspection. It's called for every poll
+// while the camera runs, and watches the Z height for the end of the first layer.
+func (i *firstLayerInspector) shouldTrigger(now time.Time) bool {
+	state, status := i.status()
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	i.observeHeight(state, status)
+	if i.done || i.layerDone || !i.inFirstLayer(state, status) || now.Sub(i.lastTrigger) < i.cfg.Interval {
+		return false
+	}
+	i.lastTrigger = now
+	return true
+}
+
+// observeHeight checks the Z height of every new poll of the job for the end of the first layer. It must be
+// called with mtx held.
+func (i *firstLayerInspector) observeHeight(state printerState, status *printerStatus) {
+	if state != statePrinting || status == nil || !status.HasAxisZ || status == i.lastStatus || status.JobID != i.job {
+		return
+	}
+	i.lastStatus = status
+
+	stable := status.AxisZ == i.previousZ
+	i.previousZ = status.AxisZ
+	if i.inFirstLayer(state, status) {
+		i.printedFirstLayer = true
+		return
+	}
+	// Before the first layer the Z height can be anywhere, eg. while the printer heats up.
+	if stable && i.printedFirstLayer {
+		i.layerDone = true
+	}
+}
+
+// inspect returns the defects of the first layer in the frame, and true if this frame failed the first
+// layer.
+func (i *firstLayerInspector) inspect(img image.Image) ([]detectedFailure, bool) {
+	state, status := i.status()
+	if state != statePrinting || status == nil || !status.HasAxisZ {
+		return nil, false
+	}
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if status.JobID != i.job || i.reference == nil {
+		// The first frame of a job is the empty bed.
+		i.reset(status.JobID, img)
+		return nil, false
+	}
+	if i.done {
+		return nil, false
+	}
+
+	final := i.layerDone
+	if final && !i.inspected {
+		// The first layer went by without an inspection, there's nothing to compare the frame with.
+		i.done = true
+		return nil, false
+	}
+
+	grid := i.grid(img)
+	diffs := make([]float64, len(grid))
+	filament := make([]bool, len(grid))
+	for c := range grid {
+		if i.inBed[c] {
+			diffs[c] = math.Abs(grid[c] - i.reference[c])
+			filament[c] = diffs[c] > i.cfg.ChangeThreshold
+		}
+	}
+
+	var defects []detectedFailure
+	minCells := max(int(i.cfg.MinDefectArea*float64(len(grid))), 1)
+	counts := map[string]int{}
+	add := func(defect string, confidence float64, mask []bool) {
+		for _, cells := range components(mask, i.width, i.height) {
+			if len(cells) < minCells {
+				continue
+			}
+			counts[defect]++
+			defects = append(defects, detectedFailure{Label: defect, Confidence: confidence, BoxCoordinates: i.box(cells)})
+		}
+	}
+
+	// Laid down filament that's gone again was detached.
+	detached := make([]bool, len(grid))
+	for c := range grid {
+		detached[c] = i.laid[c] && !filament[c]
+		if detached[c] {
+			i.laid[c] = false
+		}
+	}
+	add(defectDetached, 0.9, detached)
+
+	if i.inspected {
+		for c := range grid {
+			i.laid[c] = i.laid[c] || (filament[c] && i.filament[c])
+		}
+	}
+	add(defectBlob, 0.7, i.blobs(diffs))
+	if final {
+		add(defectGap, 0.6, i.gaps(max(int(i.cfg.MaxGapArea*float64(len(grid))), minCells)))
+	}
+
+	for _, defect := range []string{defectGap, defectBlob, defectDetached} {
+		promFirstLayerDefects.WithLabelValues(defect, i.log.printer, i.log.camera).Set(float64(counts[defect]))
+	}
+
+	i.filament = filament
+	i.inspected = true
+	if !final {
+		return defects, false
+	}
+
+	i.done = true
+	if len(defects) == 0 {
+		i.log.Println("first layer inspection passed")
+		promFirstLayerInspections.WithLabelValues("passed", i.log.printer, i.log.camera).Inc()
+		return nil, false
+	}
+	i.log.Printf("first layer inspection failed: %d gaps, %d blobs, %d detached lines\n", counts[defectGap], counts[defectBlob], counts[defectDetached])
+	promFirstLayerInspections.WithLabelValues("failed", i.log.printer, i.log.camera).Inc()
+	return defects, true
+}
+
+// reset starts the inspection of a job with the frame of the empty bed.
+func (i *firstLayerInspector) reset(job string, img image.Image) {
+	i.job = job
+	i.bed = img.Bounds()
+	if len(i.zones.include) > 0 {
+		bed := image.Rectangle{}
+		for _, zone := range i.zones.include {
+			for _, p := range zone {
+				bed = bed.Union(image.Rect(int(p.X), int(p.Y), int(p.X)+1, int(p.Y)+1))
+			}
+		}
+		i.bed = bed.Intersect(img.Bounds())
+	}
+
+	i.reference = i.grid(img)
+	i.inBed = make([]bool, len(i.reference))
+	for c := range i.inBed {
+		x, y := i.frameXY(c)
+		i.inBed[c] = !i.zones.excluded(x, y)
+	}
+	i.filament = make([]bool, len(i.reference))
+	i.laid = make([]bool, len(i.reference))
+	i.inspected = false
+	i.done = false
+	i.lastStatus = nil
+	i.previousZ = -1
+	i.printedFirstLayer = false
+	i.layerDone = false
+}
+
+// grid returns the brightness of every cell of the bed from 0 to 1.
+func (i *firstLayerInspector) grid(img image.Image) []float64 {
+	bed := imaging.Resize(imaging.Crop(img, i.bed), firstLayerWidth, 0, imaging.Box)
+	i.width, i.height = bed.Bounds().Dx(), bed.Bounds().Dy()
+	i.scale = float64(i.bed.Dx()) / float64(i.width)
+
+	grid := make([]float64, i.width*i.height)
+	for c := range grid {
+		p := bed.Pix[c*4 : c*4+3]
+		grid[c] = (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 255
+	}
+	return grid
+}
+
+// blobs returns the laid down cells that are more than twice as different from the bed as the median of
+// the layer.
+func (i *firstLayerInspector) blobs(diffs []float64) []bool {
+	var laid []float64
+	for c, in := range i.laid {
+		if in {
+			laid = append(laid, diffs[c])
+		}
+	}
+	blobs := make([]bool, len(diffs))
+	if len(laid) == 0 {
+		return blobs
+	}
+
+	slices.Sort(laid)
+	threshold := 2 * laid[len(laid)/2]
+	for c, in := range i.laid {
+		blobs[c] = in && diffs[c] > threshold
+	}
+	return blobs
+}
+
+// gaps returns the holes of at most maxCells cells in the laid down filament: the cells without filament
+// that can't be reached from the edge of the bed, and are surrounded by a single part of the layer. The bed
+// between a skirt and the parts, or between two parts, borders more than one part, and holes in the model
+// are usually larger.
+func (i *firstLayerInspector) gaps(maxCells int) []bool {
+	outside := make([]bool, len(i.laid))
+	var stack []int
+	for c := range i.laid {
+		x, y := c%i.width, c/i.width
+		edge := x == 0 || y == 0 || x == i.width-1 || y == i.height-1
+		// The cells off the bed are outside too, the layer can't have a gap there.
+		if !i.laid[c] && (edge || !i.inBed[c]) {
+			outside[c] = true
+			stack = append(stack, c)
+		}
+	}
+	for len(stack) > 0 {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, n := range neighbours(c, i.width, i.height) {
+			if !outside[n] && !i.laid[n] {
+				outside[n] = true
+				stack = append(stack, n)
+			}
+		}
+	}
+
+	// part has the part of the layer every laid down cell is in, from 1.
+	part := make([]int, len(i.laid))
+	for p, cells := range components(i.laid, i.width, i.height) {
+		for _, c := range cells {
+			part[c] = p + 1
+		}
+	}
+
+	enclosed := make([]bool, len(i.laid))
+	for c := range enclosed {
+		enclosed[c] = !i.laid[c] && !outside[c]
+	}
+	gaps := make([]bool, len(i.laid))
+	for _, cells := range components(enclosed, i.width, i.height) {
+		if len(cells) > maxCells {
+			continue
+		}
+
+		surrounding := 0
+		for _, c := range cells {
+			for _, n := range neighbours(c, i.width, i.height) {
+				if part[n] == 0 || part[n] == surrounding {
+					continue
+				}
+				if surrounding != 0 {
+					surrounding = -1
+					break
+				}
+				surrounding = part[n]
+			}
+			if surrounding < 0 {
+				break
+			}
+		}
+		if surrounding <= 0 {
+			continue
+		}
+
+		for _, c := range cells {
+			gaps[c] = true
+		}
+	}
+	return gaps
+}
+
+// frameXY returns the center of the cell in the frame.
+func (i *firstLayerInspector) frameXY(c int) (float64, float64) {
+	x, y := c%i.width, c/i.width
+	return float64(i.bed.Min.X) + (float64(x)+0.5)*i.scale, float64(i.bed.Min.Y) + (float64(y)+0.5)*i.scale
+}
+
+// box returns the box of the cells in the frame, as the x, y of its center, its width and height.
+func (i *firstLayerInspector) box(cells []int) [4]float64 {
+	minX, minY, maxX, maxY := i.width, i.height, -1, -1
+	for _, c := range cells {
+		x, y := c%i.width, c/i.width
+		minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+	}
+
+	w := float64(maxX-minX+1) * i.scale
+	h := float64(maxY-minY+1) * i.scale
+	return [4]float64{float64(i.bed.Min.X) + float64(minX)*i.scale + w/2, float64(i.bed.Min.Y) + float64(minY)*i.scale + h/2, w, h}
+}
@@ -2,6 +2,7 @@ package cli
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -26,21 +27,31 @@ const (
 type generateTimelapseCommand struct {
 	LokiURL      string `kong:"help='The URL to the Loki API to fetch logs from.',required,name='loki-url'"`
 	LokiUsername string `kong:"help='The username to authenticate with the Loki API.',optional,name='loki-username'"`
-	LokiPassword string `kong:"help='The password to authenticate with the Loki API.',optional,name='loki-password'"`
+	LokiPassword string `kong:"help='The password to authenticate with the Loki API.',optional,name='loki-password',env='PRUSALGTM_LOKI_PASSWORD'"`
+	// Keeps the password out of ps.
+	LokiPasswordFile string `kong:"help='A file with the password to authenticate with the Loki API.',optional,name='loki-password-file',type='path'"`
 
 	LogQLQuery string    `kong:"help='The LogQL query to fetch logs.',default='{unit=\"prusaLGTM.service\"} |= \"base64\"',name='logql-query'"`
 	StartTime  time.Time `kong:"help='The start time of the logs to fetch.',required,name='start-time'"`
 	EndTime    time.Time `kong:"help='The end time of the logs to fetch.',required,name='end-time'"`
 
+	// Farm mode logs the frames of every printer and camera to the same stream.
+	Printer string `kong:"help='Only use the frames of this printer, for the frames logged by farm.',optional,name='printer'"`
+	Camera  string `kong:"help='Only use the frames of this camera, for printers with more than one camera.',optional,name='camera'"`
+
 	EncodeToMP4 bool   `kong:"help='Whether to encode the timelapse to MP4. Requires ffmpeg',default='false',name='encode-to-mp4'"`
 	OutputPath  string `kong:"help='The path to save the timelapse video.',default='videos/',name='output-path'"`
 }
 
-func (g *generateTimelapseCommand) Run() error {
-	client := newLokiClient(g.LokiURL, g.LogQLQuery, g.LokiUsername, g.LokiPassword)
+func (g *generateTimelapseCommand) Run(ctx context.Context) error {
+	password, err := readSecret(g.LokiPassword, g.LokiPasswordFile)
+	if err != nil {
+		return err
+	}
+	client := newLokiClient(g.LokiURL, g.LogQLQuery, g.LokiUsername, password)
 
 	// First seek to the first line.
-	resp, err := client.fetchLogs(g.StartTime, g.EndTime, 1)
+	resp, err := client.fetchLogs(ctx, g.StartTime, g.EndTime, 1)
 	if err != nil {
 		return fmt.Errorf("failed to fetch logs: %w", err)
 	}
@@ -64,6 +75,41 @@ func (g *generateTimelapseCommand) Run() error {
 
 	printCount := 0
 	var timeLapse timelapseFile
+	// source is the printer and camera of the first frame, the frames of a timelapse must all come from it.
+	var source *[2]string
+
+	// Finalise the timelapse we were writing if we stop early, otherwise the AVI is left without an index.
+	defer func() {
+		if timeLapse.isEmpty() {
+			return
+		}
+
+		if err := timeLapse.abort(); err != nil {
+			fmt.Println(err)
+			return
+		}
+		if timeLapse.framesInVideo > 0 {
+			fmt.Printf("timelapse interrupted, saved the frames so far: %s\n", timeLapse.fileName)
+		}
+	}()
+
+	// finish closes the timelapse that is being written, and encodes it.
+	finish := func() error {
+		fmt.Printf("timelapse generated: %d\n", printCount)
+		printCount++
+		fileName := timeLapse.fileName
+		err := timeLapse.close()
+		timeLapse = timelapseFile{}
+		if err != nil {
+			return fmt.Errorf("failed to close timelapse writer: %w", err)
+		}
+		if g.EncodeToMP4 {
+			if err := encodeToMP4(ctx, fileName); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
 	// Each line is 200KB, so we fetch 5mins at once.
 	for start.Before(g.EndTime) {
@@ -72,8 +118,11 @@ func (g *generateTimelapseCommand) Run() error {
 			end = g.EndTime
 		}
 
-		resp, err := client.fetchLogs(start, end, 1000)
+		resp, err := client.fetchLogs(ctx, start, end, 1000)
 		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("interrupted: %w", ctx.Err())
+			}
 			return fmt.Errorf("failed to fetch logs: %w", err)
 		}
 		start = end
@@ -83,78 +132,92 @@ func (g *generateTimelapseCommand) Run() error {
 		}
 
 		streams := resp.Data.Result.(loghttp.Streams)
-		if len(streams) == 0 {
-			// We found no logs for this 5min period. Close any open timelapse writers.
-			if !timeLapse.isEmpty() {
-				fmt.Printf("timelapse generated: %d\n", printCount)
-				printCount++
-				if err := timeLapse.close(); err != nil {
-					return fmt.Errorf("failed to close timelapse writer: %w", err)
-				}
-				if g.EncodeToMP4 {
-					if err := encodeToMP4(timeLapse.fileName); err != nil {
-						return err
-					}
-				}
-
-				timeLapse = timelapseFile{}
-			}
-
-			continue
-		}
 		if len(streams) > 1 {
 			return fmt.Errorf("unexpected number of streams: %d", len(streams))
 		}
 
-		if timeLapse.isEmpty() {
-			fmt.Printf("timelapse started: %d\n", printCount)
+		frames := 0
+		for _, stream := range streams {
+			for _, entry := range stream.Entries {
+				printer, camera, imgBytes, err := parseImageLogLine(entry.Line)
+				if err != nil {
+					return fmt.Errorf("failed to decode base64 image. timestamp: %s, error: %w, log_size: %d", entry.Timestamp, err, len(entry.Line))
+				}
+				if (g.Printer != "" && printer != g.Printer) || (g.Camera != "" && camera != g.Camera) {
+					continue
+				}
+				if source == nil {
+					source = &[2]string{printer, camera}
+				} else if *source != [2]string{printer, camera} {
+					return fmt.Errorf("the query has frames from more than one printer or camera (%s, %s and %s, %s), pick one with --printer and --camera", source[0], source[1], printer, camera)
+				}
 
-			timeLapse, err = newTimelapseFile(path.Join(g.OutputPath, fmt.Sprintf("timelapse-%d-%s.avi", printCount, start.Format("2006-01-02"))))
-			if err != nil {
-				return fmt.Errorf("failed to create mjpeg writer: %w", err)
-			}
-		}
+				_, err = jpeg.Decode(bytes.NewReader(imgBytes))
+				if err != nil {
+					return fmt.Errorf("failed to decode jpeg image. timestamp: %s, error: %w, log_size: %d", entry.Timestamp, err, len(entry.Line))
+				}
 
-		stream := streams[0]
-		for _, entry := range stream.Entries {
-			base64Image := strings.TrimPrefix(entry.Line, formatString)
-			imgBytes, err := base64.StdEncoding.DecodeString(base64Image)
-			if err != nil {
-				return fmt.Errorf("failed to decode base64 image. timestamp: %s, error: %w, log_size: %d", entry.Timestamp, err, len(entry.Line))
-			}
-			_, err = jpeg.Decode(bytes.NewReader(imgBytes))
-			if err != nil {
-				return fmt.Errorf("failed to decode jpeg image. timestamp: %s, error: %w, log_size: %d", entry.Timestamp, err, len(entry.Line))
+				if timeLapse.isEmpty() {
+					fmt.Printf("timelapse started: %d\n", printCount)
+
+					timeLapse, err = newTimelapseFile(path.Join(g.OutputPath, fmt.Sprintf("timelapse-%d-%s.avi", printCount, start.Format("2006-01-02"))))
+					if err != nil {
+						return fmt.Errorf("failed to create mjpeg writer: %w", err)
+					}
+				}
+				if err := timeLapse.addFrame(imgBytes); err != nil {
+					return fmt.Errorf("failed to add image to timelapse: %w", err)
+				}
+				frames++
 			}
+		}
 
-			if err := timeLapse.addFrame(imgBytes); err != nil {
-				return fmt.Errorf("failed to add image to timelapse: %w", err)
+		// We found no frames for this 5min period. Close any open timelapse writers.
+		if frames == 0 && !timeLapse.isEmpty() {
+			if err := finish(); err != nil {
+				return err
 			}
 		}
 	}
 	if !timeLapse.isEmpty() {
-		fmt.Printf("timelapse generated: %d\n", printCount)
-		if err := timeLapse.close(); err != nil {
-			return fmt.Errorf("failed to close timelapse writer: %w", err)
-		}
-		if g.EncodeToMP4 {
-			if err := encodeToMP4(timeLapse.fileName); err != nil {
-				return err
-			}
+		if err := finish(); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
-func encodeToMP4(timelapseFileName string) error {
+// parseImageLogLine returns the JPEG logged in the line, and the printer and camera of the logger that
+// logged it, which are empty for a single printer.
+func parseImageLogLine(line string) (string, string, []byte, error) {
+	prefix, base64Image, _ := strings.Cut(line, formatString)
+
+	// The prefix of the logger is "printer=<printer> camera=<camera> ", and the names can have spaces.
+	var printer, camera string
+	prefix = strings.TrimSuffix(prefix, " ")
+	if i := strings.LastIndex(prefix, "camera="); i == 0 || (i > 0 && prefix[i-1] == ' ') {
+		camera = prefix[i+len("camera="):]
+		prefix = strings.TrimSuffix(prefix[:i], " ")
+	}
+	if v, ok := strings.CutPrefix(prefix, "printer="); ok {
+		printer = v
+	}
+
+	imgBytes, err := base64.StdEncoding.DecodeString(base64Image)
+	return printer, camera, imgBytes, err
+}
+
+// encodeToMP4 encodes the timelapse with ffmpeg. An interrupted encode doesn't leave a partial MP4 behind.
+func encodeToMP4(ctx context.Context, timelapseFileName string) error {
 	// Execute ffmpeg -i input.avi -c:v mpeg4 output.mp4
 	outputFile := fmt.Sprintf("%s.mp4", strings.TrimSuffix(timelapseFileName, ".avi"))
 
 	tmpFile := fmt.Sprintf("%s.tmp.mp4", outputFile)
-	cmd := exec.Command("ffmpeg", "-i", timelapseFileName, "-c:v", "mpeg4", "-qscale", "0", tmpFile)
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-i", timelapseFileName, "-c:v", "mpeg4", "-qscale", "0", tmpFile)
 
 	if err := cmd.Run(); err != nil {
+		os.Remove(tmpFile)
 		return fmt.Errorf("failed to reencode timelapse: %w, command: %s", err, cmd.String())
 	}
 
@@ -200,6 +263,22 @@ func (t *timelapseFile) close() error {
 	return nil
 }
 
+// abort closes the writer of a timelapse that wasn't finished, so the frames written so far can be played.
+// A timelapse without frames is removed.
+func (t *timelapseFile) abort() error {
+	if err := t.close(); err != nil {
+		return err
+	}
+
+	if t.framesInVideo == 0 {
+		if err := os.Remove(t.fileName); err != nil {
+			return fmt.Errorf("failed to remove empty timelapse: %w", err)
+		}
+	}
+
+	return nil
+}
+
 func (t *timelapseFile) isEmpty() bool {
 	return t.timeLapseWriter == nil
 }
@@ -226,13 +305,13 @@ func newLokiClient(url, query, username, password string) *lokiClient {
 	}
 }
 
-func (l *lokiClient) fetchLogs(start, end time.Time, limit int) (*loghttp.QueryResponse, error) {
+func (l *lokiClient) fetchLogs(ctx context.Context, start, end time.Time, limit int) (*loghttp.QueryResponse, error) {
 	query_url, err := url.JoinPath(l.URL, "/loki/api/v1/query_range")
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodGet, query_url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, query_url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,245 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gouthamve/prusaLGTM/camera"
+)
+
+type HealthConfig struct {
+	StaleAfter time.Duration `kong:"help='Report the process as unhealthy when a running camera or the printer poller has been stuck for this long.',default='2m',name='health-stale-after'"`
+}
+
+// componentHealth is the health of a part of a pipeline. A component that isn't healthy is stuck and
+// fails /healthz, so that the process gets restarted. A component that isn't ready fails /readyz.
+type componentHealth struct {
+	Component string         `json:"component"`
+	Printer   string         `json:"printer,omitempty"`
+	Camera    string         `json:"camera,omitempty"`
+	Healthy   bool           `json:"healthy"`
+	Ready     bool           `json:"ready"`
+	Message   string         `json:"message,omitempty"`
+	Details   map[string]any `json:"details,omitempty"`
+}
+
+type healthReport struct {
+	Healthy    bool              `json:"healthy"`
+	Ready      bool              `json:"ready"`
+	Components []componentHealth `json:"components"`
+}
+
+type healthCheck func() componentHealth
+
+// healthRegistry has the health checks of the running pipelines. Pipelines add their checks when they
+// start and remove them when they stop.
+type healthRegistry struct {
+	mtx    sync.Mutex
+	nextID int
+	checks map[int]healthCheck
+}
+
+var healthChecks = &healthRegistry{checks: map[int]healthCheck{}}
+
+// add adds a check and returns the function that removes it.
+func (r *healthRegistry) add(check healthCheck) func() {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	id := r.nextID
+	r.nextID++
+	r.checks[id] = check
+
+	return func() {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+
+		delete(r.checks, id)
+	}
+}
+
+func (r *healthRegistry) report() healthReport {
+	r.mtx.Lock()
+	checks := make([]healthCheck, 0, len(r.checks))
+	for _, check := range r.checks {
+		checks = append(checks, check)
+	}
+	r.mtx.Unlock()
+
+	// Nothing is ready until a pipeline has started.
+	report := healthReport{
+		Healthy:    true,
+		Ready:      len(checks) > 0,
+		Components: make([]componentHealth, 0, len(checks)),
+	}
+	for _, check := range checks {
+		component := check()
+		report.Healthy = report.Healthy && component.Healthy
+		report.Ready = report.Ready && component.Ready
+		report.Components = append(report.Components, component)
+	}
+
+	sort.Slice(report.Components, func(i, j int) bool {
+		a, b := report.Components[i], report.Components[j]
+		if a.Printer != b.Printer {
+			return a.Printer < b.Printer
+		}
+		if a.Camera != b.Camera {
+			return a.Camera < b.Camera
+		}
+		return a.Component < b.Component
+	})
+
+	return report
+}
+
+// HealthzHandler serves the health report, with a 503 if a component is stuck.
+func HealthzHandler() http.Handler {
+	return healthHandler(func(report healthReport) bool { return report.Healthy })
+}
+
+// ReadyzHandler serves the health report, with a 503 if a component isn't ready.
+func ReadyzHandler() http.Handler {
+	return healthHandler(func(report healthReport) bool { return report.Ready })
+}
+
+func healthHandler(ok func(healthReport) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := healthChecks.report()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if !ok(report) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	})
+}
+
+// NotifySystemdWatchdog pings the systemd watchdog while the process is healthy, when the unit has
+// WatchdogSec set. systemd restarts the process once the pings stop. It returns when ctx is done.
+func NotifySystemdWatchdog(ctx context.Context) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if socket == "" || err != nil || usec <= 0 {
+		return
+	}
+
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		fmt.Println("failed to connect to the systemd notify socket:", err)
+		return
+	}
+	defer conn.Close()
+
+	// systemd recommends pinging at half the timeout.
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !healthChecks.report().Healthy {
+				continue
+			}
+			if _, err := conn.Write([]byte("WATCHDOG=1")); err != nil {
+				fmt.Println("failed to ping the systemd watchdog:", err)
+			}
+		}
+	}
+}
+
+func cameraHealthCheck(cam *camera.Camera, log logger, staleAfter time.Duration) healthCheck {
+	return func() componentHealth {
+		running, lastFrame := cam.Running(), cam.LastFrame()
+
+		health := componentHealth{
+			Component: "camera",
+			Printer:   log.printer,
+			Camera:    log.camera,
+			Healthy:   true,
+			Ready:     true,
+			Details:   map[string]any{"running": running},
+		}
+		if !lastFrame.IsZero() {
+			health.Details["last_frame"] = lastFrame
+		}
+
+		if running && time.Since(lastFrame) > staleAfter {
+			health.Healthy = false
+			health.Message = fmt.Sprintf("no frame from the camera for %s", time.Since(lastFrame).Round(time.Second))
+		}
+
+		return health
+	}
+}
+
+func printerHealthCheck(tracker *printerStateTracker, printer printerBackend, pollInterval, staleAfter time.Duration) healthCheck {
+	return func() componentHealth {
+		state, _ := tracker.current()
+		lastPoll, failedPolls, err := tracker.lastPollResult()
+
+		health := componentHealth{
+			Component: "printer",
+			Printer:   tracker.log.printer,
+			Healthy:   true,
+			Ready:     state != stateUnknown,
+			Details: map[string]any{
+				"backend":      printer.name(),
+				"state":        state,
+				"last_poll":    lastPoll,
+				"failed_polls": failedPolls,
+			},
+		}
+		if err != nil {
+			health.Details["last_error"] = err.Error()
+		}
+		if !health.Ready {
+			health.Message = "the printer state is unknown"
+		}
+
+		// A poll that never returns stops the camera from following the printer.
+		if time.Since(lastPoll) > pollInterval+staleAfter {
+			health.Healthy = false
+			health.Message = fmt.Sprintf("no printer poll finished for %s", time.Since(lastPoll).Round(time.Second))
+		}
+
+		return health
+	}
+}
+
+func detectorHealthCheck(detector *failureDetector) healthCheck {
+	return func() componentHealth {
+		lastSuccess, err := detector.lastResult()
+
+		health := componentHealth{
+			Component: "ml-api",
+			Printer:   detector.log.printer,
+			Healthy:   true,
+			Ready:     err == nil,
+			Details:   map[string]any{"url": detector.MLAPIURL.Redacted(), "circuit_breaker_open": detector.breakerOpen()},
+		}
+		if !lastSuccess.IsZero() {
+			health.Details["last_success"] = lastSuccess
+		}
+		if err != nil {
+			health.Message = "the last call to the ML API failed"
+			health.Details["last_error"] = err.Error()
+		}
+
+		return health
+	}
+}
@@ -0,0 +1,371 @@
+package cli
+
+import (
+	"image"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+type HeuristicConfig struct {
+	Detector        string        `kong:"help='What detects the failures: the ML API at --ml-api-url, or heuristics built into prusaLGTM that compare the frames of a camera and need no ML API.',default='ml-api',enum='ml-api,heuristic',name='detector'"`
+	ChangeThreshold float64       `kong:"help='The difference in brightness, from 0 to 1, at which the heuristics see a part of the frame as changed.',default='0.12',name='heuristic-change-threshold'"`
+	MinBlobArea     float64       `kong:"help='The smallest change outside of the print, as a fraction of the frame, that the heuristics report.',default='0.002',name='heuristic-min-blob-area'"`
+	LearnFrames     int           `kong:"help='The number of frames at the start of a job the heuristics learn where the print is from.',default='20',name='heuristic-learn-frames'"`
+	StallAfter      time.Duration `kong:"help='Report the nozzle when nothing moved and the progress stayed the same for this long while printing. Needs a printer URL.',default='10m',name='heuristic-stall-after'"`
+}
+
+const (
+	detectorMLAPI     = "ml-api"
+	detectorHeuristic = "heuristic"
+
+	// heuristicWidth is the width the frames are scaled down to, which also evens out the camera noise.
+	heuristicWidth = 160
+	// heuristicPersistence is the number of frames in a row a part of the frame has to stay changed to be
+	// more than the print head going past.
+	heuristicPersistence = 3
+	// heuristicMinMotion is the number of changed cells between two frames that means something moved.
+	heuristicMinMotion = 4
+)
+
+// heuristicDetector finds failures without an ML API, from how the frames of a camera change during a job:
+//
+//   - The first frames of the job learn the footprint of the print: where the first layers changed the
+//     frame. The print grows up towards the top of the frame from there.
+//   - Outside of the footprint the frames are compared to the frame at the start of the job. A part that
+//     changed and stays changed is a blob, like spaghetti or a part knocked off the bed. The confidence of a
+//     blob rises with every frame it grows in.
+//   - When nothing moved and the progress of the printer didn't change for --heuristic-stall-after, the
+//     nozzle is reported where it last moved.
+type heuristicDetector struct {
+	cfg HeuristicConfig
+	// status returns the printer state, nil without a printer. It's set by print-image before the detector
+	// is used.
+	status func() (printerState, *printerStatus)
+
+	mtx     sync.Mutex
+	cameras map[string]*heuristicCamera
+}
+
+func newHeuristicDetector(cfg HeuristicConfig) *heuristicDetector {
+	return &heuristicDetector{
+		cfg:     cfg,
+		cameras: map[string]*heuristicCamera{},
+	}
+}
+
+// heuristicCamera is what the heuristics learnt from the frames of a camera during the current job. The
+// frames are scaled down to a grid of cells with the brightness of each.
+type heuristicCamera struct {
+	job           string
+	width, height int
+	// scale is the size of a cell in the frame.
+	scale float64
+
+	frames    int
+	reference []float64
+	previous  []float64
+	// changed is the number of frames in a row each cell differed from the reference.
+	changed   []int
+	learnt    []bool
+	footprint []bool
+	blobs     []heuristicBlob
+
+	lastMotion      time.Time
+	motionBox       [4]float64
+	progress        float64
+	progressChanged time.Time
+}
+
+type heuristicBlob struct {
+	cells map[int]bool
+	// growth is the number of frames the blob grew in.
+	growth int
+}
+
+// detect returns the failures in the frame of the camera. The frames of a camera must come in order.
+func (h *heuristicDetector) detect(camera string, img image.Image, now time.Time) []detectedFailure {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	grid, width, height := brightnessGrid(img)
+
+	state, status := stateUnknown, (*printerStatus)(nil)
+	if h.status != nil {
+		state, status = h.status()
+	}
+	job := ""
+	if status != nil {
+		job = status.JobID
+	}
+
+	c := h.cameras[camera]
+	if c == nil || c.job != job || c.width != width || c.height != height {
+		// A new job starts from scratch.
+		c = &heuristicCamera{
+			job:             job,
+			width:           width,
+			height:          height,
+			scale:           float64(img.Bounds().Dx()) / float64(width),
+			reference:       grid,
+			previous:        grid,
+			changed:         make([]int, len(grid)),
+			learnt:          make([]bool, len(grid)),
+			lastMotion:      now,
+			progressChanged: now,
+		}
+		h.cameras[camera] = c
+		return nil
+	}
+
+	failures := c.blobFailures(grid, h.cfg)
+	if stalled := c.stalled(grid, state, status, now, h.cfg); stalled != nil {
+		failures = append(failures, *stalled)
+	}
+	c.previous = grid
+
+	return failures
+}
+
+// brightnessGrid scales the frame down to heuristicWidth cells across and returns the brightness of every
+// cell from 0 to 1, minus the average so that changes in the lighting of the room cancel out.
+func brightnessGrid(img image.Image) ([]float64, int, int) {
+	small := imaging.Resize(img, heuristicWidth, 0, imaging.Box)
+	width, height := small.Bounds().Dx(), small.Bounds().Dy()
+
+	grid := make([]float64, width*height)
+	sum := 0.0
+	for i := range grid {
+		p := small.Pix[i*4 : i*4+3]
+		grid[i] = (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 255
+		sum += grid[i]
+	}
+
+	mean := sum / float64(len(grid))
+	for i := range grid {
+		grid[i] -= mean
+	}
+
+	return grid, width, height
+}
+
+// blobFailures learns the footprint of the print from the first frames, and then returns the blobs outside
+// of it.
+func (c *heuristicCamera) blobFailures(grid []float64, cfg HeuristicConfig) []detectedFailure {
+	for i := range grid {
+		if math.Abs(grid[i]-c.reference[i]) > cfg.ChangeThreshold {
+			c.changed[i]++
+		} else {
+			c.changed[i] = 0
+		}
+	}
+
+	if c.footprint == nil {
+		c.frames++
+		learnt := false
+		for i, n := range c.changed {
+			c.learnt[i] = c.learnt[i] || n >= heuristicPersistence
+			learnt = learnt || c.learnt[i]
+		}
+		// Keep learning until the first layers show up.
+		if c.frames >= cfg.LearnFrames && learnt {
+			c.footprint = c.footprintFrom(c.learnt)
+		}
+		return nil
+	}
+
+	// The print changes the frame inside its footprint all the time.
+	for i, in := range c.footprint {
+		if in {
+			c.reference[i] = grid[i]
+			c.changed[i] = 0
+		}
+	}
+
+	var (
+		failures []detectedFailure
+		blobs    []heuristicBlob
+	)
+	minCells := int(cfg.MinBlobArea * float64(len(grid)))
+	stayed := make([]bool, len(c.changed))
+	for i, n := range c.changed {
+		stayed[i] = n >= heuristicPersistence
+	}
+	for _, cells := range components(stayed, c.width, c.height) {
+		if len(cells) < max(minCells, 1) {
+			continue
+		}
+
+		blob := heuristicBlob{cells: make(map[int]bool, len(cells))}
+		for _, cell := range cells {
+			blob.cells[cell] = true
+		}
+		// The blob of the last frame it overlaps the most is the same blob.
+		if previous, ok := c.matchBlob(blob); ok {
+			blob.growth = previous.growth
+			if len(blob.cells) > len(previous.cells) {
+				blob.growth++
+			}
+		}
+		blobs = append(blobs, blob)
+
+		failures = append(failures, detectedFailure{
+			Confidence:     min(0.2+0.15*float64(blob.growth), 0.95),
+			BoxCoordinates: c.box(cells),
+		})
+	}
+	c.blobs = blobs
+
+	return failures
+}
+
+// footprintFrom returns the footprint of the print from the cells the first layers changed: their
+// columns, with a margin, from below them up to the top of the frame.
+func (c *heuristicCamera) footprintFrom(learnt []bool) []bool {
+	minX, maxX, maxY := c.width, -1, -1
+	for i, in := range learnt {
+		if !in {
+			continue
+		}
+		x, y := i%c.width, i/c.width
+		minX, maxX, maxY = min(minX, x), max(maxX, x), max(maxY, y)
+	}
+
+	margin := max(c.width/20, 1)
+	footprint := make([]bool, len(learnt))
+	for y := 0; y <= min(maxY+margin, c.height-1); y++ {
+		for x := max(minX-margin, 0); x <= min(maxX+margin, c.width-1); x++ {
+			footprint[y*c.width+x] = true
+		}
+	}
+
+	return footprint
+}
+
+func (c *heuristicCamera) matchBlob(blob heuristicBlob) (heuristicBlob, bool) {
+	var (
+		best    heuristicBlob
+		overlap int
+	)
+	for _, previous := range c.blobs {
+		n := 0
+		for cell := range blob.cells {
+			if previous.cells[cell] {
+				n++
+			}
+		}
+		if n > overlap {
+			best, overlap = previous, n
+		}
+	}
+
+	return best, overlap > 0
+}
+
+// box returns the box of the cells in the frame, as the x, y of its center, its width and height.
+func (c *heuristicCamera) box(cells []int) [4]float64 {
+	minX, minY, maxX, maxY := c.width, c.height, -1, -1
+	for _, cell := range cells {
+		x, y := cell%c.width, cell/c.width
+		minX, minY, maxX, maxY = min(minX, x), min(minY, y), max(maxX, x), max(maxY, y)
+	}
+
+	w := float64(maxX-minX+1) * c.scale
+	h := float64(maxY-minY+1) * c.scale
+	return [4]float64{float64(minX)*c.scale + w/2, float64(minY)*c.scale + h/2, w, h}
+}
+
+// stalled returns the nozzle when nothing moved and the progress didn't change for --heuristic-stall-after
+// while printing. The confidence is 0.5 then, and rises the longer it stays like that.
+func (c *heuristicCamera) stalled(grid []float64, state printerState, status *printerStatus, now time.Time, cfg HeuristicConfig) *detectedFailure {
+	var moved []int
+	for i := range grid {
+		if math.Abs(grid[i]-c.previous[i]) > cfg.ChangeThreshold {
+			moved = append(moved, i)
+		}
+	}
+	if len(moved) >= heuristicMinMotion {
+		c.lastMotion = now
+		// The print head is what moves the most during a print.
+		c.motionBox = c.box(moved)
+	}
+
+	// Without a printer there's no progress to compare with, and a paused printer doesn't move.
+	if status == nil || state != statePrinting {
+		c.progressChanged = now
+		return nil
+	}
+	if status.Progress != c.progress {
+		c.progress = status.Progress
+		c.progressChanged = now
+	}
+
+	stalled := min(now.Sub(c.lastMotion), now.Sub(c.progressChanged))
+	if cfg.StallAfter <= 0 || stalled < cfg.StallAfter {
+		return nil
+	}
+
+	box := c.motionBox
+	if box[2] == 0 {
+		// Nothing moved since the job started, the whole frame is stuck.
+		w, h := float64(c.width)*c.scale, float64(c.height)*c.scale
+		box = [4]float64{w / 2, h / 2, w, h}
+	}
+
+	return &detectedFailure{
+		Label:          "stalled",
+		Confidence:     min(0.5*float64(stalled)/float64(cfg.StallAfter), 0.95),
+		BoxCoordinates: box,
+	}
+}
+
+// components returns the connected groups of cells of the mask.
+func components(mask []bool, width, height int) [][]int {
+	seen := make([]bool, len(mask))
+	var groups [][]int
+	for start, in := range mask {
+		if seen[start] || !in {
+			continue
+		}
+
+		var cells []int
+		stack := []int{start}
+		seen[start] = true
+		for len(stack) > 0 {
+			c := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			cells = append(cells, c)
+
+			for _, n := range neighbours(c, width, height) {
+				if !seen[n] && mask[n] {
+					seen[n] = true
+					stack = append(stack, n)
+				}
+			}
+		}
+		groups = append(groups, cells)
+	}
+
+	return groups
+}
+
+// neighbours returns the cells left, right, above and below the cell of a grid.
+func neighbours(c, width, height int) []int {
+	x, y := c%width, c/width
+	n := make([]int, 0, 4)
+	if x > 0 {
+		n = append(n, c-1)
+	}
+	if x < width-1 {
+		n = append(n, c+1)
+	}
+	if y > 0 {
+		n = append(n, c-width)
+	}
+	if y < height-1 {
+		n = append(n, c+width)
+	}
+	return n
+}
@@ -0,0 +1,136 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The boxes of the labels are in the format of the detections: the x, y of the center of the box, its width
+// and height, in pixels.
+
+// cocoDataset is the part of the COCO object detection format that is about boxes.
+type cocoDataset struct {
+	Images      []cocoImage      `json:"images"`
+	Annotations []cocoAnnotation `json:"annotations"`
+	Categories  []cocoCategory   `json:"categories"`
+}
+
+type cocoImage struct {
+	ID       int    `json:"id"`
+	FileName string `json:"file_name"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+type cocoAnnotation struct {
+	ID         int `json:"id"`
+	ImageID    int `json:"image_id"`
+	CategoryID int `json:"category_id"`
+	// BBox is the x, y of the top left corner, width and height.
+	BBox    [4]float64 `json:"bbox"`
+	Area    float64    `json:"area"`
+	IsCrowd int        `json:"iscrowd"`
+	// Score is only set for detections.
+	Score *float64 `json:"score,omitempty"`
+}
+
+type cocoCategory struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// readCOCOLabels returns the boxes of every image of the COCO file by file name. With classes, only the
+// annotations of the categories with those names are returned.
+func readCOCOLabels(path string, classes []string) (map[string][][4]float64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataset cocoDataset
+	if err := json.Unmarshal(data, &dataset); err != nil {
+		return nil, fmt.Errorf("invalid COCO labels %s: %w", path, err)
+	}
+
+	categories := map[int]bool{}
+	for _, category := range dataset.Categories {
+		categories[category.ID] = len(classes) == 0 || slices.Contains(classes, category.Name)
+	}
+
+	fileNames := map[int]string{}
+	labels := map[string][][4]float64{}
+	for _, img := range dataset.Images {
+		fileNames[img.ID] = img.FileName
+		labels[img.FileName] = nil
+	}
+
+	for _, annotation := range dataset.Annotations {
+		fileName, ok := fileNames[annotation.ImageID]
+		if !ok {
+			return nil, fmt.Errorf("invalid COCO labels %s: annotation %d is for unknown image %d", path, annotation.ID, annotation.ImageID)
+		}
+		if !categories[annotation.CategoryID] {
+			continue
+		}
+
+		x, y, w, h := annotation.BBox[0], annotation.BBox[1], annotation.BBox[2], annotation.BBox[3]
+		labels[fileName] = append(labels[fileName], [4]float64{x + w/2, y + h/2, w, h})
+	}
+
+	return labels, nil
+}
+
+// yoloLabelsPath returns the YOLO labels file of an image: the txt file of the same name in the labels
+// directory.
+func yoloLabelsPath(labelsDir, imagePath string) string {
+	name := strings.TrimSuffix(filepath.Base(imagePath), filepath.Ext(imagePath))
+	return filepath.Join(labelsDir, name+".txt")
+}
+
+// readYOLOLabels returns the boxes of a YOLO labels file for an image of the given size. A missing file is
+// an image without labels. With classes, only the boxes of those class ids are returned.
+func readYOLOLabels(path string, width, height int, classes []string) ([][4]float64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var boxes [][4]float64
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("%s:%d: expected class x y width height, got %d fields", path, line, len(fields))
+		}
+		if len(classes) > 0 && !slices.Contains(classes, fields[0]) {
+			continue
+		}
+
+		// The coordinates are relative to the size of the image.
+		var box [4]float64
+		for i, field := range fields[1:] {
+			v, err := strconv.ParseFloat(field, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			box[i] = v
+		}
+		boxes = append(boxes, [4]float64{box[0] * float64(width), box[1] * float64(height), box[2] * float64(width), box[3] * float64(height)})
+	}
+
+	return boxes, scanner.Err()
+}
@@ -0,0 +1,37 @@
+package cli
+
+import "fmt"
+
+// logger prints log lines to stdout, prefixed with the printer and camera they are about. This is how the
+// lines of the different printers in farm mode are told apart, and the printer is also used as the
+// printer label of the metrics.
+type logger struct {
+	printer string
+	camera  string
+	prefix  string
+}
+
+func newLogger(printer, camera string) logger {
+	prefix := ""
+	if printer != "" {
+		prefix += "printer=" + printer + " "
+	}
+	if camera != "" {
+		prefix += "camera=" + camera + " "
+	}
+
+	return logger{
+		printer: printer,
+		camera:  camera,
+		prefix:  prefix,
+	}
+}
+
+// Println prints the line in a single write, so lines from different goroutines don't interleave.
+func (l logger) Println(a ...any) {
+	fmt.Print(l.prefix + fmt.Sprintln(a...))
+}
+
+func (l logger) Printf(format string, a ...any) {
+	fmt.Print(l.prefix + fmt.Sprintf(format, a...))
+}
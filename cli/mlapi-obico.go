@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	mlProtocolPrusaLGTM = "prusalgtm"
+	mlProtocolObico     = "obico"
+
+	mlAPIFramesPath = "/ml-api/frames/"
+)
+
+// mlAPIFrames has the frames Obico's ml_api is fetching. The ML API gets the URL of the frame instead of
+// the frame, so every frame is served on the Prometheus port while its request is in flight. The random
+// name of the frame is the only access control, as the ML API can't authenticate.
+var mlAPIFrames = &mlFrameStore{frames: map[string][]byte{}}
+
+type mlFrameStore struct {
+	mtx    sync.Mutex
+	frames map[string][]byte
+}
+
+// add serves the JPEG until the returned function is called.
+func (s *mlFrameStore) add(frame []byte) (string, func(), error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", nil, err
+	}
+	name := hex.EncodeToString(id)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.frames[name] = frame
+
+	return name, func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		delete(s.frames, name)
+	}, nil
+}
+
+func (s *mlFrameStore) get(name string) ([]byte, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	frame, ok := s.frames[name]
+	return frame, ok
+}
+
+// MLAPIFramesHandler serves the frames of the requests to Obico's ml_api under /ml-api/frames/.
+func MLAPIFramesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, mlAPIFramesPath), ".jpg")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		frame, ok := mlAPIFrames.get(name)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(frame)
+	})
+}
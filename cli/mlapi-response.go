@@ -0,0 +1,132 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	mlDecoderLoose  = "loose"
+	mlDecoderStrict = "strict"
+)
+
+// mlDetection is a detection of the ML API, encoded as [label, confidence, [x, y, width, height]] with the
+// x, y of the center of the box. Both the prusaLGTM and the Obico ML APIs use it.
+type mlDetection struct {
+	Label      string
+	Confidence float64
+	Box        [4]float64
+}
+
+func (d *mlDetection) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("expected [label, confidence, box], got %s", data)
+	}
+	if len(fields) != 3 {
+		return fmt.Errorf("expected [label, confidence, box], got %d elements", len(fields))
+	}
+
+	if err := json.Unmarshal(fields[0], &d.Label); err != nil {
+		return fmt.Errorf("expected the label to be a string, got %s", fields[0])
+	}
+	if err := json.Unmarshal(fields[1], &d.Confidence); err != nil {
+		return fmt.Errorf("expected the confidence to be a number, got %s", fields[1])
+	}
+
+	var box []float64
+	if err := json.Unmarshal(fields[2], &box); err != nil || len(box) != 4 {
+		return fmt.Errorf("expected the box to be [x, y, width, height], got %s", fields[2])
+	}
+	copy(d.Box[:], box)
+
+	return nil
+}
+
+// validate checks that the detection makes sense for a frame of the given size.
+func (d mlDetection) validate(width, height int) error {
+	if d.Confidence < 0 || d.Confidence > 1 {
+		return fmt.Errorf("confidence %v is not between 0 and 1", d.Confidence)
+	}
+
+	x, y, w, h := d.Box[0], d.Box[1], d.Box[2], d.Box[3]
+	if w <= 0 || h <= 0 {
+		return fmt.Errorf("box %v has no area", d.Box)
+	}
+	if x < 0 || y < 0 || x > float64(width) || y > float64(height) {
+		return fmt.Errorf("the center of box %v is outside of the %dx%d frame", d.Box, width, height)
+	}
+
+	return nil
+}
+
+func (d mlDetection) failure() detectedFailure {
+	return detectedFailure{Label: d.Label, Confidence: d.Confidence, BoxCoordinates: d.Box}
+}
+
+// decodeDetections decodes the response of the ML API for a frame of the given size. The loose decoder
+// skips the detections it can't make sense of and ignores unknown fields, the strict decoder fails the
+// whole response on the first problem.
+func (f *failureDetector) decodeDetections(body []byte, width, height int) ([]detectedFailure, error) {
+	if f.cfg.Decoder == mlDecoderStrict {
+		return decodeDetectionsStrict(body, width, height)
+	}
+
+	var resp struct {
+		Detections []json.RawMessage `json:"detections"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("invalid ML API response: %w", err)
+	}
+
+	failures := make([]detectedFailure, 0, len(resp.Detections))
+	for i, raw := range resp.Detections {
+		var detection mlDetection
+		err := json.Unmarshal(raw, &detection)
+		if err == nil {
+			err = detection.validate(width, height)
+		}
+		if err != nil {
+			f.log.Printf("skipping detection %d of the ML API response: %v\n", i, err)
+			continue
+		}
+
+		failures = append(failures, detection.failure())
+	}
+
+	return failures, nil
+}
+
+func decodeDetectionsStrict(body []byte, width, height int) ([]detectedFailure, error) {
+	var resp struct {
+		Detections *[]json.RawMessage `json:"detections"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("invalid ML API response: %w", err)
+	}
+	if dec.More() {
+		return nil, errors.New("invalid ML API response: unexpected data after the JSON object")
+	}
+	if resp.Detections == nil {
+		return nil, errors.New("invalid ML API response: missing detections")
+	}
+
+	failures := make([]detectedFailure, 0, len(*resp.Detections))
+	for i, raw := range *resp.Detections {
+		var detection mlDetection
+		if err := json.Unmarshal(raw, &detection); err != nil {
+			return nil, fmt.Errorf("invalid detection %d in the ML API response: %w", i, err)
+		}
+		if err := detection.validate(width, height); err != nil {
+			return nil, fmt.Errorf("invalid detection %d in the ML API response: %w", i, err)
+		}
+
+		failures = append(failures, detection.failure())
+	}
+
+	return failures, nil
+}
@@ -0,0 +1,174 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	promMoonrakerDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prusalgtm",
+			Name:      "moonraker_request_duration_seconds",
+			Help:      "A histogram of request latencies to the Moonraker API.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"code", "method", "printer"},
+	)
+)
+
+// moonrakerClient talks to the Moonraker API of a Klipper printer.
+type moonrakerClient struct {
+	url    *url.URL
+	apiKey string
+	client *http.Client
+}
+
+func newMoonrakerClient(moonrakerURL *url.URL, apiKey string, log logger) *moonrakerClient {
+	return &moonrakerClient{
+		url:    moonrakerURL,
+		apiKey: apiKey,
+		client: &http.Client{
+			Timeout:   printerRequestTimeout,
+			Transport: promhttp.InstrumentRoundTripperDuration(promMoonrakerDuration.MustCurryWith(prometheus.Labels{"printer": log.printer}), http.DefaultTransport),
+		},
+	}
+}
+
+func (m *moonrakerClient) name() string {
+	return "Moonraker"
+}
+
+func (m *moonrakerClient) status(ctx context.Context) (*printerStatus, error) {
+	queryURL := m.url.JoinPath("/printer/objects/query")
+	// The objects are query parameters without values.
+	queryURL.RawQuery = "webhooks&print_stats&virtual_sdcard&gcode_move&extruder&heater_bed"
+
+	var resp moonrakerQueryResponse
+	if err := m.do(ctx, http.MethodGet, queryURL, &resp); err != nil {
+		return nil, err
+	}
+
+	objects := resp.Result.Status
+	status := &printerStatus{
+		State:        moonrakerState(objects.Webhooks.State, objects.PrintStats.State),
+		RawState:     objects.PrintStats.State,
+		JobID:        objects.PrintStats.Filename,
+		JobName:      objects.PrintStats.Filename,
+		Progress:     objects.VirtualSDCard.Progress * 100,
+		TimePrinting: time.Duration(objects.PrintStats.PrintDuration * float64(time.Second)),
+		TempBed:      objects.HeaterBed.Temperature,
+		TargetBed:    objects.HeaterBed.Target,
+		TempNozzle:   objects.Extruder.Temperature,
+		TargetNozzle: objects.Extruder.Target,
+	}
+	if objects.Webhooks.State != "ready" {
+		status.RawState = objects.Webhooks.State
+	}
+	if len(objects.GCodeMove.GCodePosition) >= 3 {
+		status.AxisZ = objects.GCodeMove.GCodePosition[2]
+		status.HasAxisZ = true
+	}
+	// Moonraker doesn't estimate the remaining time, so use the progress like its clients do.
+	if objects.VirtualSDCard.Progress > 0 && objects.PrintStats.State == "printing" {
+		total := float64(status.TimePrinting) / objects.VirtualSDCard.Progress
+		status.TimeRemaining = time.Duration(total) - status.TimePrinting
+	}
+
+	return status, nil
+}
+
+// moonrakerState maps the Klippy state and the print_stats state into a printer state.
+func moonrakerState(klippyState, printState string) printerState {
+	switch klippyState {
+	case "ready":
+	case "startup":
+		return stateBusy
+	case "shutdown", "error":
+		return stateError
+	default:
+		return stateUnknown
+	}
+
+	switch printState {
+	case "standby":
+		return stateIdle
+	case "printing":
+		return statePrinting
+	case "paused":
+		return statePaused
+	case "complete":
+		return stateFinished
+	case "cancelled":
+		return stateStopped
+	case "error":
+		return stateError
+	}
+
+	return stateUnknown
+}
+
+func (m *moonrakerClient) pauseJob(ctx context.Context, _ string) error {
+	return m.do(ctx, http.MethodPost, m.url.JoinPath("/printer/print/pause"), nil)
+}
+
+func (m *moonrakerClient) do(ctx context.Context, method string, u *url.URL, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if m.apiKey != "" {
+		req.Header.Set("X-Api-Key", m.apiKey)
+	}
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Moonraker %s %s failed. status: %s", method, u.Path, resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type moonrakerTemperature struct {
+	Temperature float64 `json:"temperature"`
+	Target      float64 `json:"target"`
+}
+
+type moonrakerQueryResponse struct {
+	Result struct {
+		Status struct {
+			Webhooks struct {
+				State string `json:"state"`
+			} `json:"webhooks"`
+			PrintStats struct {
+				State         string  `json:"state"`
+				Filename      string  `json:"filename"`
+				PrintDuration float64 `json:"print_duration"`
+			} `json:"print_stats"`
+			VirtualSDCard struct {
+				Progress float64 `json:"progress"`
+			} `json:"virtual_sdcard"`
+			GCodeMove struct {
+				GCodePosition []float64 `json:"gcode_position"`
+			} `json:"gcode_move"`
+			Extruder  moonrakerTemperature `json:"extruder"`
+			HeaterBed moonrakerTemperature `json:"heater_bed"`
+		} `json:"status"`
+	} `json:"result"`
+}
@@ -0,0 +1,502 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promMQTTConnected = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "mqtt_connected",
+			Help:      "1 if connected to the MQTT broker, 0 otherwise.",
+		},
+		[]string{"printer"},
+	)
+	promMQTTMessages = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "mqtt_messages_published_total",
+			Help:      "The number of messages published to MQTT by kind.",
+		},
+		[]string{"kind", "printer"},
+	)
+)
+
+type MQTTConfig struct {
+	BrokerURL    string `kong:"help='The URL of the MQTT broker, eg. tcp://localhost:1883 or ssl://localhost:8883. Publishing to MQTT is enabled when it is set.',optional,name='mqtt-broker-url'"`
+	Username     string `kong:"help='The username for the MQTT broker.',optional,name='mqtt-username'"`
+	Password     string `kong:"help='The password for the MQTT broker.',optional,name='mqtt-password',env='PRUSALGTM_MQTT_PASSWORD'"`
+	PasswordFile string `kong:"help='A file with the password for the MQTT broker.',optional,name='mqtt-password-file',type='path'"`
+	ClientID     string `kong:"help='The MQTT client ID. Defaults to prusalgtm-<printer>.',optional,name='mqtt-client-id'"`
+
+	TopicPrefix     string `kong:"help='The prefix of the state and camera topics.',default='prusalgtm',name='mqtt-topic-prefix'"`
+	DiscoveryPrefix string `kong:"help='The Home Assistant discovery prefix. Empty disables discovery.',default='homeassistant',name='mqtt-discovery-prefix'"`
+
+	SnapshotInterval time.Duration `kong:"help='The interval at which to publish the latest frame on the camera topic. 0 disables it.',default='30s',name='mqtt-snapshot-interval'"`
+	SnapshotSize     ImageSize     `kong:"help='Maximum size of the published frames in pixels.',default='720',name='mqtt-snapshot-size',enum='1080,720,480,360,240'"`
+
+	TLSCAFile             string `kong:"help='A CA certificate file to verify the MQTT broker with.',optional,name='mqtt-tls-ca-file',type='path'"`
+	TLSCertFile           string `kong:"help='A client certificate file for the MQTT broker.',optional,name='mqtt-tls-cert-file',type='path'"`
+	TLSKeyFile            string `kong:"help='The key file of the client certificate.',optional,name='mqtt-tls-key-file',type='path'"`
+	TLSInsecureSkipVerify bool   `kong:"help='Do not verify the certificate of the MQTT broker.',default='false',name='mqtt-tls-insecure-skip-verify'"`
+}
+
+// mqttState is the payload of the state topic.
+type mqttState struct {
+	State         printerState `json:"state"`
+	JobName       string       `json:"job_name"`
+	Progress      float64      `json:"progress"`
+	TimePrinting  float64      `json:"time_printing"`
+	TimeRemaining float64      `json:"time_remaining"`
+	AxisZ         *float64     `json:"axis_z,omitempty"`
+	TempBed       float64      `json:"temp_bed"`
+	TargetBed     float64      `json:"target_bed"`
+	TempNozzle    float64      `json:"temp_nozzle"`
+	TargetNozzle  float64      `json:"target_nozzle"`
+}
+
+// mqttDetection is the payload of the detection topic.
+type mqttDetection struct {
+	Failures      int     `json:"failures"`
+	MaxConfidence float64 `json:"max_confidence"`
+	Score         float64 `json:"score"`
+	Level         string  `json:"level"`
+}
+
+// mqttPublisher publishes the printer state, the detection results and the frames of the cameras of a
+// printer to MQTT, along with the Home Assistant discovery configs for them.
+type mqttPublisher struct {
+	cfg     MQTTConfig
+	client  mqtt.Client
+	log     logger
+	cameras []string
+
+	// id is the printer name as used in topics and entity IDs.
+	id string
+
+	mtx       sync.Mutex
+	connected bool
+	frames    map[string]image.Image
+	// retained has the last payload of the state and detection topics. Messages published while
+	// disconnected are dropped, so they are published again on connect.
+	retained map[string][]byte
+}
+
+var mqttIDReplacer = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// mqttID makes a name safe to use in topics and Home Assistant entity IDs.
+func mqttID(name string) string {
+	return strings.Trim(mqttIDReplacer.ReplaceAllString(name, "_"), "_")
+}
+
+// newMQTTPublisher returns nil if no broker is configured. It starts connecting in the background, and
+// keeps reconnecting until close is called.
+func newMQTTPublisher(cfg MQTTConfig, cameras []string, log logger) (*mqttPublisher, error) {
+	return newMQTTPublisherWithClient(cfg, cameras, log, mqtt.NewClient)
+}
+
+// newMQTTPublisherWithClient is newMQTTPublisher with the client created by newClient.
+func newMQTTPublisherWithClient(cfg MQTTConfig, cameras []string, log logger, newClient func(*mqtt.ClientOptions) mqtt.Client) (*mqttPublisher, error) {
+	if cfg.BrokerURL == "" {
+		return nil, nil
+	}
+
+	password, err := readSecret(cfg.Password, cfg.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	id := "printer"
+	if log.printer != "" {
+		id = mqttID(log.printer)
+	}
+
+	p := &mqttPublisher{
+		cfg:      cfg,
+		log:      log,
+		cameras:  cameras,
+		id:       id,
+		frames:   map[string]image.Image{},
+		retained: map[string][]byte{},
+	}
+
+	clientID := cfg.ClientID
+	if clientID == "" {
+		clientID = "prusalgtm-" + id
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.BrokerURL).
+		SetClientID(clientID).
+		SetUsername(cfg.Username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetWill(p.topic("availability"), "offline", 1, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(p.onConnectionLost)
+
+	if cfg.TLSCAFile != "" || cfg.TLSCertFile != "" || cfg.TLSInsecureSkipVerify {
+		tlsConfig, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	p.client = newClient(opts)
+	// With ConnectRetry the token only completes once connected, so don't wait for it.
+	p.client.Connect()
+
+	return p, nil
+}
+
+func (cfg MQTTConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.TLSInsecureSkipVerify}
+
+	if cfg.TLSCAFile != "" {
+		ca, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MQTT CA file: %w", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.TLSCAFile)
+		}
+	}
+
+	if cfg.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load MQTT client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+func (p *mqttPublisher) topic(parts ...string) string {
+	return strings.Join(append([]string{p.cfg.TopicPrefix, p.id}, parts...), "/")
+}
+
+// onConnect publishes the discovery configs on every connect, so that they are there after the broker
+// restarts.
+func (p *mqttPublisher) onConnect(client mqtt.Client) {
+	p.log.Println("connected to MQTT broker", p.cfg.BrokerURL)
+	p.setConnected(true)
+
+	if p.cfg.DiscoveryPrefix != "" {
+		for _, config := range p.discoveryConfigs() {
+			payload, err := json.Marshal(config.payload)
+			if err != nil {
+				p.log.Println("failed to encode discovery config:", err)
+				continue
+			}
+			p.publish("discovery", config.topic, true, payload)
+		}
+	}
+
+	p.publish("availability", p.topic("availability"), true, []byte("online"))
+
+	p.mtx.Lock()
+	retained := make(map[string][]byte, len(p.retained))
+	for topic, payload := range p.retained {
+		retained[topic] = payload
+	}
+	p.mtx.Unlock()
+
+	for topic, payload := range retained {
+		p.client.Publish(topic, 1, true, payload)
+	}
+}
+
+func (p *mqttPublisher) onConnectionLost(client mqtt.Client, err error) {
+	p.log.Println("lost connection to MQTT broker, reconnecting:", err)
+	p.setConnected(false)
+}
+
+func (p *mqttPublisher) setConnected(connected bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.connected = connected
+	if connected {
+		promMQTTConnected.WithLabelValues(p.log.printer).Set(1)
+	} else {
+		promMQTTConnected.WithLabelValues(p.log.printer).Set(0)
+	}
+}
+
+func (p *mqttPublisher) publish(kind, topic string, retained bool, payload []byte) {
+	p.client.Publish(topic, 1, retained, payload)
+	promMQTTMessages.WithLabelValues(kind, p.log.printer).Inc()
+}
+
+// publishRetained publishes a retained message that is published again on every connect.
+func (p *mqttPublisher) publishRetained(kind, topic string, payload []byte) {
+	p.mtx.Lock()
+	p.retained[topic] = payload
+	p.mtx.Unlock()
+
+	p.publish(kind, topic, true, payload)
+}
+
+type mqttDiscoveryConfig struct {
+	topic   string
+	payload map[string]any
+}
+
+// discoveryConfigs returns the Home Assistant MQTT discovery configs of the printer sensors and cameras.
+func (p *mqttPublisher) discoveryConfigs() []mqttDiscoveryConfig {
+	name := "prusaLGTM"
+	if p.log.printer != "" {
+		name = p.log.printer
+	}
+	nodeID := "prusalgtm_" + p.id
+	device := map[string]any{
+		"identifiers":  []string{nodeID},
+		"name":         name,
+		"manufacturer": "prusaLGTM",
+	}
+
+	var configs []mqttDiscoveryConfig
+	add := func(component, objectID string, payload map[string]any) {
+		payload["unique_id"] = nodeID + "_" + objectID
+		payload["object_id"] = nodeID + "_" + objectID
+		payload["device"] = device
+		payload["availability_topic"] = p.topic("availability")
+
+		configs = append(configs, mqttDiscoveryConfig{
+			topic:   strings.Join([]string{p.cfg.DiscoveryPrefix, component, nodeID, objectID, "config"}, "/"),
+			payload: payload,
+		})
+	}
+	sensor := func(objectID, name, topic, template string, extra map[string]any) {
+		payload := map[string]any{
+			"name":           name,
+			"state_topic":    topic,
+			"value_template": template,
+		}
+		for k, v := range extra {
+			payload[k] = v
+		}
+		add("sensor", objectID, payload)
+	}
+
+	state := p.topic("state")
+	sensor("state", "State", state, "{{ value_json.state }}", nil)
+	sensor("job_name", "Job", state, "{{ value_json.job_name }}", nil)
+	sensor("progress", "Progress", state, "{{ value_json.progress }}", map[string]any{"unit_of_measurement": "%"})
+	sensor("time_remaining", "Time remaining", state, "{{ value_json.time_remaining }}", map[string]any{"unit_of_measurement": "s", "device_class": "duration"})
+	sensor("axis_z", "Z height", state, "{{ value_json.axis_z }}", map[string]any{"unit_of_measurement": "mm"})
+	temperature := map[string]any{"unit_of_measurement": "°C", "device_class": "temperature"}
+	sensor("temp_bed", "Bed temperature", state, "{{ value_json.temp_bed }}", temperature)
+	sensor("temp_nozzle", "Nozzle temperature", state, "{{ value_json.temp_nozzle }}", temperature)
+
+	// Every camera has its own detections and failure score.
+	for _, camera := range p.cameras {
+		suffix, nameSuffix := "", ""
+		if camera != "" {
+			suffix, nameSuffix = "_"+mqttID(camera), " "+camera
+		}
+		detection := p.detectionTopic(camera)
+		sensor("failures"+suffix, "Failures detected"+nameSuffix, detection, "{{ value_json.failures }}", nil)
+		sensor("failure_confidence"+suffix, "Failure confidence"+nameSuffix, detection, "{{ value_json.max_confidence }}", nil)
+		sensor("failure_score"+suffix, "Failure score"+nameSuffix, detection, "{{ value_json.score }}", nil)
+		sensor("failure_level"+suffix, "Failure level"+nameSuffix, detection, "{{ value_json.level }}", nil)
+	}
+
+	if p.cfg.SnapshotInterval > 0 {
+		for _, camera := range p.cameras {
+			objectID, name := "camera", "Camera"
+			if camera != "" {
+				objectID = "camera_" + mqttID(camera)
+				name = "Camera " + camera
+			}
+			add("camera", objectID, map[string]any{
+				"name":  name,
+				"topic": p.cameraTopic(camera),
+			})
+		}
+	}
+
+	return configs
+}
+
+func (p *mqttPublisher) cameraTopic(camera string) string {
+	if camera == "" {
+		return p.topic("camera")
+	}
+	return p.topic("camera", mqttID(camera))
+}
+
+func (p *mqttPublisher) detectionTopic(camera string) string {
+	if camera == "" {
+		return p.topic("detection")
+	}
+	return p.topic("detection", mqttID(camera))
+}
+
+// run publishes the printer state on every poll and the latest frames every SnapshotInterval, until ctx is
+// done. tracker can be nil if there is no printer.
+func (p *mqttPublisher) run(ctx context.Context, tracker *printerStateTracker, pollInterval time.Duration) {
+	var states <-chan time.Time
+	if tracker != nil {
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		states = ticker.C
+	}
+
+	var snapshots <-chan time.Time
+	if p.cfg.SnapshotInterval > 0 {
+		ticker := time.NewTicker(p.cfg.SnapshotInterval)
+		defer ticker.Stop()
+		snapshots = ticker.C
+	}
+
+	var (
+		lastState  printerState
+		lastStatus *printerStatus
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-states:
+			// The tracker keeps the last status when the printer becomes unreachable, so the state can
+			// change without a new status.
+			state, status := tracker.current()
+			if state == lastState && status == lastStatus && status != nil {
+				continue
+			}
+			lastState, lastStatus = state, status
+			p.publishState(state, status)
+		case <-snapshots:
+			p.publishFrames()
+		}
+	}
+}
+
+func (p *mqttPublisher) publishState(state printerState, status *printerStatus) {
+	payload := mqttState{State: state}
+	if status != nil {
+		payload.JobName = status.JobName
+		payload.Progress = status.Progress
+		payload.TimePrinting = status.TimePrinting.Seconds()
+		payload.TimeRemaining = status.TimeRemaining.Seconds()
+		if status.HasAxisZ {
+			payload.AxisZ = &status.AxisZ
+		}
+		payload.TempBed = status.TempBed
+		payload.TargetBed = status.TargetBed
+		payload.TempNozzle = status.TempNozzle
+		payload.TargetNozzle = status.TargetNozzle
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		p.log.Println("failed to encode MQTT state:", err)
+		return
+	}
+	p.publishRetained("state", p.topic("state"), encoded)
+}
+
+// frameHandler returns the frame handler of the camera. It takes frames twice as often as they are
+// published, so there's always a recent one.
+func (p *mqttPublisher) frameHandler(camera string) frameHandler {
+	return frameHandler{interval: everyInterval(p.cfg.SnapshotInterval / 2), handle: func(img image.Image) {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+
+		p.frames[camera] = img
+	}}
+}
+
+func (p *mqttPublisher) publishFrames() {
+	p.mtx.Lock()
+	frames := p.frames
+	p.frames = map[string]image.Image{}
+	p.mtx.Unlock()
+
+	for camera, img := range frames {
+		if img.Bounds().Dy() > int(p.cfg.SnapshotSize) {
+			img = imaging.Resize(img, 0, int(p.cfg.SnapshotSize), imaging.Lanczos)
+		}
+
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, nil); err != nil {
+			p.log.Println("failed to encode MQTT frame:", err)
+			continue
+		}
+		// Frames aren't retained, an old frame is worse than no frame.
+		p.publish("camera", p.cameraTopic(camera), false, buf.Bytes())
+	}
+}
+
+// observe publishes the failures detected in a frame on the detection topic of its camera.
+func (p *mqttPublisher) observe(_ context.Context, d detection) {
+	payload := mqttDetection{Failures: len(d.failures), Score: d.score, Level: d.level.String()}
+	for _, failure := range d.failures {
+		if failure.Confidence > payload.MaxConfidence {
+			payload.MaxConfidence = failure.Confidence
+		}
+	}
+
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		p.log.Println("failed to encode MQTT detection:", err)
+		return
+	}
+	p.publishRetained("detection", p.detectionTopic(d.camera), encoded)
+}
+
+// close marks the printer offline and disconnects.
+func (p *mqttPublisher) close() {
+	if p.client.IsConnected() {
+		p.client.Publish(p.topic("availability"), 1, true, "offline").WaitTimeout(time.Second)
+	}
+	p.client.Disconnect(250)
+	p.setConnected(false)
+}
+
+func (p *mqttPublisher) healthCheck() healthCheck {
+	return func() componentHealth {
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+
+		health := componentHealth{
+			Component: "mqtt",
+			Printer:   p.log.printer,
+			Healthy:   true,
+			Ready:     p.connected,
+			Details:   map[string]any{"broker": p.cfg.BrokerURL, "connected": p.connected},
+		}
+		if !p.connected {
+			health.Message = "not connected to the MQTT broker"
+		}
+
+		return health
+	}
+}
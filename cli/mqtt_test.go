@@ -0,0 +1,443 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+type mqttMessage struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+// fakeMQTTClient stands in for the connection to the broker. It records the messages, and connects as soon
+// as Connect is called.
+type fakeMQTTClient struct {
+	opts *mqtt.ClientOptions
+
+	mtx       sync.Mutex
+	connected bool
+	messages  []mqttMessage
+}
+
+func (c *fakeMQTTClient) IsConnected() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.connected
+}
+
+func (c *fakeMQTTClient) IsConnectionOpen() bool { return c.IsConnected() }
+
+func (c *fakeMQTTClient) Connect() mqtt.Token {
+	c.mtx.Lock()
+	c.connected = true
+	c.mtx.Unlock()
+
+	c.opts.OnConnect(c)
+	return &mqtt.DummyToken{}
+}
+
+// connectionLost drops the connection like a broker restart.
+func (c *fakeMQTTClient) connectionLost() {
+	c.mtx.Lock()
+	c.connected = false
+	c.mtx.Unlock()
+
+	c.opts.OnConnectionLost(c, errors.New("broker went away"))
+}
+
+func (c *fakeMQTTClient) Disconnect(uint) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.connected = false
+}
+
+func (c *fakeMQTTClient) Publish(topic string, _ byte, retained bool, payload interface{}) mqtt.Token {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	msg := mqttMessage{topic: topic, retained: retained}
+	switch p := payload.(type) {
+	case string:
+		msg.payload = p
+	case []byte:
+		msg.payload = string(p)
+	}
+	c.messages = append(c.messages, msg)
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeMQTTClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeMQTTClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return &mqtt.DummyToken{}
+}
+
+func (c *fakeMQTTClient) Unsubscribe(...string) mqtt.Token { return &mqtt.DummyToken{} }
+
+func (c *fakeMQTTClient) AddRoute(string, mqtt.MessageHandler) {}
+
+func (c *fakeMQTTClient) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+// published returns the messages published to topic.
+func (c *fakeMQTTClient) published(topic string) []mqttMessage {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var messages []mqttMessage
+	for _, msg := range c.messages {
+		if msg.topic == topic {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+func (c *fakeMQTTClient) reset() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.messages = nil
+}
+
+func newTestMQTTPublisher(t *testing.T, cameras []string) (*mqttPublisher, *fakeMQTTClient) {
+	t.Helper()
+
+	client := &fakeMQTTClient{}
+	cfg := MQTTConfig{
+		BrokerURL:        "tcp://localhost:1883",
+		TopicPrefix:      "prusalgtm",
+		DiscoveryPrefix:  "homeassistant",
+		SnapshotInterval: 30 * time.Second,
+		SnapshotSize:     ImageSize_720p,
+	}
+	publisher, err := newMQTTPublisherWithClient(cfg, cameras, newLogger("mk4", ""), func(opts *mqtt.ClientOptions) mqtt.Client {
+		client.opts = opts
+		return client
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publisher, client
+}
+
+// lastRetained returns the payload of the last message on topic, which must be retained.
+func lastRetained(t *testing.T, client *fakeMQTTClient, topic string) map[string]any {
+	t.Helper()
+
+	messages := client.published(topic)
+	if len(messages) == 0 {
+		t.Fatalf("nothing published to %s", topic)
+	}
+	msg := messages[len(messages)-1]
+	if !msg.retained {
+		t.Errorf("expected the message on %s to be retained", topic)
+	}
+
+	var payload map[string]any
+	if err := json.Unmarshal([]byte(msg.payload), &payload); err != nil {
+		t.Fatalf("the message on %s isn't JSON: %v", topic, err)
+	}
+	return payload
+}
+
+func TestMQTTAvailability(t *testing.T) {
+	publisher, client := newTestMQTTPublisher(t, []string{""})
+
+	// The broker marks the printer offline if prusaLGTM goes away without closing.
+	opts := client.opts
+	if !opts.WillEnabled || opts.WillTopic != "prusalgtm/mk4/availability" || string(opts.WillPayload) != "offline" || !opts.WillRetained {
+		t.Errorf("expected a retained offline will on the availability topic, got enabled=%t topic=%q payload=%q retained=%t", opts.WillEnabled, opts.WillTopic, opts.WillPayload, opts.WillRetained)
+	}
+
+	messages := client.published("prusalgtm/mk4/availability")
+	if len(messages) != 1 || messages[0].payload != "online" || !messages[0].retained {
+		t.Fatalf("expected a retained online message on connect, got %+v", messages)
+	}
+
+	publisher.close()
+	messages = client.published("prusalgtm/mk4/availability")
+	if last := messages[len(messages)-1]; last.payload != "offline" || !last.retained {
+		t.Errorf("expected a retained offline message on close, got %+v", last)
+	}
+}
+
+func TestMQTTDiscovery(t *testing.T) {
+	_, client := newTestMQTTPublisher(t, []string{"top", "side"})
+
+	state := lastRetained(t, client, "homeassistant/sensor/prusalgtm_mk4/progress/config")
+	if state["state_topic"] != "prusalgtm/mk4/state" || state["availability_topic"] != "prusalgtm/mk4/availability" {
+		t.Errorf("unexpected progress sensor config: %v", state)
+	}
+	if state["unique_id"] != "prusalgtm_mk4_progress" {
+		t.Errorf("expected the unique ID to include the printer, got %v", state["unique_id"])
+	}
+
+	for _, camera := range []string{"top", "side"} {
+		score := lastRetained(t, client, "homeassistant/sensor/prusalgtm_mk4/failure_score_"+camera+"/config")
+		if score["state_topic"] != "prusalgtm/mk4/detection/"+camera {
+			t.Errorf("expected the failure score of %s on its own detection topic, got %v", camera, score["state_topic"])
+		}
+		if score["name"] != "Failure score "+camera {
+			t.Errorf("expected the failure score to be named after %s, got %v", camera, score["name"])
+		}
+
+		cam := lastRetained(t, client, "homeassistant/camera/prusalgtm_mk4/camera_"+camera+"/config")
+		if cam["topic"] != "prusalgtm/mk4/camera/"+camera {
+			t.Errorf("unexpected camera config for %s: %v", camera, cam)
+		}
+	}
+}
+
+func TestMQTTRetainedStateAndDetections(t *testing.T) {
+	publisher, client := newTestMQTTPublisher(t, []string{"top", "side"})
+
+	publisher.publishState(statePrinting, &printerStatus{State: statePrinting, JobName: "benchy.gcode", Progress: 42, HasAxisZ: true, AxisZ: 1.2})
+	state := lastRetained(t, client, "prusalgtm/mk4/state")
+	if state["state"] != "PRINTING" || state["job_name"] != "benchy.gcode" || state["progress"] != 42.0 || state["axis_z"] != 1.2 {
+		t.Errorf("unexpected state: %v", state)
+	}
+
+	publisher.observe(context.Background(), detection{
+		camera:   "top",
+		failures: []detectedFailure{{Confidence: 0.4}, {Confidence: 0.8}},
+		score:    0.6,
+		level:    levelWarning,
+	})
+	top := lastRetained(t, client, "prusalgtm/mk4/detection/top")
+	if top["failures"] != 2.0 || top["max_confidence"] != 0.8 || top["score"] != 0.6 || top["level"] != levelWarning.String() {
+		t.Errorf("unexpected detection: %v", top)
+	}
+	publisher.observe(context.Background(), detection{camera: "side"})
+	if side := lastRetained(t, client, "prusalgtm/mk4/detection/side"); side["failures"] != 0.0 {
+		t.Errorf("unexpected detection of the other camera: %v", side)
+	}
+	if top := lastRetained(t, client, "prusalgtm/mk4/detection/top"); top["failures"] != 2.0 {
+		t.Errorf("the other camera overwrote the detection: %v", top)
+	}
+
+	// After the broker restarts the retained messages are gone, so they are published again.
+	client.connectionLost()
+	client.reset()
+	client.Connect()
+	if state := lastRetained(t, client, "prusalgtm/mk4/state"); state["job_name"] != "benchy.gcode" {
+		t.Errorf("expected the state again after reconnecting, got %v", state)
+	}
+	if top := lastRetained(t, client, "prusalgtm/mk4/detection/top"); top["failures"] != 2.0 {
+		t.Errorf("expected the detection again after reconnecting, got %v", top)
+	}
+	lastRetained(t, client, "homeassistant/sensor/prusalgtm_mk4/state/config")
+}
+
+func TestMQTTUnreachablePrinter(t *testing.T) {
+	publisher, client := newTestMQTTPublisher(t, []string{""})
+	tracker := newPrinterStateTracker(1, 1, newLogger("mk4", ""))
+	tracker.update(&printerStatus{State: statePrinting, JobID: "1", JobName: "benchy.gcode"}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		publisher.run(ctx, tracker, 5*time.Millisecond)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	waitForState := func(want string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if messages := client.published("prusalgtm/mk4/state"); len(messages) > 0 {
+				var state map[string]any
+				if err := json.Unmarshal([]byte(messages[len(messages)-1].payload), &state); err == nil && state["state"] == want {
+					return
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("expected the state to become %s", want)
+	}
+
+	waitForState("PRINTING")
+	// The tracker keeps the last status of an unreachable printer, the state changes on its own.
+	tracker.update(nil, errors.New("connection refused"))
+	waitForState("UNKNOWN")
+}
+
+// brokerMessages collects the messages a subscriber gets from the broker.
+type brokerMessages struct {
+	mtx      sync.Mutex
+	messages []mqttMessage
+}
+
+func (b *brokerMessages) handle(_ mqtt.Client, msg mqtt.Message) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.messages = append(b.messages, mqttMessage{topic: msg.Topic(), retained: msg.Retained(), payload: string(msg.Payload())})
+}
+
+// waitFor waits for a message on topic that matches, and returns it.
+func (b *brokerMessages) waitFor(t *testing.T, topic string, match func(mqttMessage) bool) mqttMessage {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mtx.Lock()
+		for _, msg := range b.messages {
+			if msg.topic == topic && match(msg) {
+				b.mtx.Unlock()
+				return msg
+			}
+		}
+		b.mtx.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no matching message on %s", topic)
+	return mqttMessage{}
+}
+
+func (b *brokerMessages) topics() map[string]bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	topics := map[string]bool{}
+	for _, msg := range b.messages {
+		topics[msg.topic] = true
+	}
+	return topics
+}
+
+func waitForToken(t *testing.T, token mqtt.Token) {
+	t.Helper()
+
+	if !token.WaitTimeout(10 * time.Second) {
+		t.Fatal("timed out waiting for the broker")
+	}
+	if err := token.Error(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// subscribe returns the messages of the printer from the broker, from a subscriber of their own.
+func subscribe(t *testing.T, brokerURL, id, name string) *brokerMessages {
+	t.Helper()
+
+	messages := &brokerMessages{}
+	subscriber := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID(id + "-" + name))
+	waitForToken(t, subscriber.Connect())
+	t.Cleanup(func() { subscriber.Disconnect(250) })
+	waitForToken(t, subscriber.SubscribeMultiple(map[string]byte{
+		"prusalgtm/" + id + "/#":                        1,
+		"homeassistant/+/prusalgtm_" + id + "/+/config": 1,
+	}, messages.handle))
+
+	return messages
+}
+
+// TestMQTTBroker runs the publisher against a real broker, like mosquitto, when PRUSALGTM_TEST_MQTT_BROKER
+// is its URL, eg. tcp://localhost:1883.
+func TestMQTTBroker(t *testing.T) {
+	brokerURL := os.Getenv("PRUSALGTM_TEST_MQTT_BROKER")
+	if brokerURL == "" {
+		t.Skip("PRUSALGTM_TEST_MQTT_BROKER isn't set")
+	}
+
+	// A printer of its own, so the retained messages of other runs don't get in the way.
+	printer := fmt.Sprintf("test%d", time.Now().UnixNano())
+	id := mqttID(printer)
+	live := subscribe(t, brokerURL, id, "live")
+	t.Cleanup(func() {
+		// Clear the retained messages of the test.
+		cleaner := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(brokerURL).SetClientID(id + "-cleaner"))
+		if token := cleaner.Connect(); !token.WaitTimeout(10*time.Second) || token.Error() != nil {
+			return
+		}
+		defer cleaner.Disconnect(250)
+		for topic := range live.topics() {
+			cleaner.Publish(topic, 1, true, "").WaitTimeout(time.Second)
+		}
+	})
+
+	// The connection of the publisher is kept to drop it like a crash would, without a DISCONNECT.
+	var (
+		connMtx sync.Mutex
+		conn    net.Conn
+	)
+	cfg := MQTTConfig{
+		BrokerURL:       brokerURL,
+		TopicPrefix:     "prusalgtm",
+		DiscoveryPrefix: "homeassistant",
+		SnapshotSize:    ImageSize_720p,
+	}
+	publisher, err := newMQTTPublisherWithClient(cfg, []string{"top"}, newLogger(printer, ""), func(opts *mqtt.ClientOptions) mqtt.Client {
+		opts.SetCustomOpenConnectionFn(func(uri *url.URL, _ mqtt.ClientOptions) (net.Conn, error) {
+			c, err := net.DialTimeout("tcp", uri.Host, 10*time.Second)
+			connMtx.Lock()
+			conn = c
+			connMtx.Unlock()
+			return c, err
+		})
+		return mqtt.NewClient(opts)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(publisher.close)
+
+	publisher.publishState(statePrinting, &printerStatus{State: statePrinting, JobName: "benchy.gcode", Progress: 42})
+	publisher.observe(context.Background(), detection{camera: "top", failures: []detectedFailure{{Confidence: 0.8}}, score: 0.6, level: levelWarning})
+
+	anyMessage := func(mqttMessage) bool { return true }
+	live.waitFor(t, "prusalgtm/"+id+"/state", anyMessage)
+	live.waitFor(t, "prusalgtm/"+id+"/detection/top", anyMessage)
+	live.waitFor(t, "homeassistant/sensor/prusalgtm_"+id+"/failure_score_top/config", anyMessage)
+
+	// A subscriber that comes later gets the retained messages.
+	late := subscribe(t, brokerURL, id, "late")
+	retained := func(msg mqttMessage) bool { return msg.retained }
+	decode := func(msg mqttMessage) map[string]any {
+		var payload map[string]any
+		if err := json.Unmarshal([]byte(msg.payload), &payload); err != nil {
+			t.Fatalf("the message on %s isn't JSON: %v", msg.topic, err)
+		}
+		return payload
+	}
+
+	late.waitFor(t, "prusalgtm/"+id+"/availability", func(msg mqttMessage) bool { return msg.retained && msg.payload == "online" })
+	if state := decode(late.waitFor(t, "prusalgtm/"+id+"/state", retained)); state["state"] != "PRINTING" || state["job_name"] != "benchy.gcode" {
+		t.Errorf("unexpected state: %v", state)
+	}
+	if top := decode(late.waitFor(t, "prusalgtm/"+id+"/detection/top", retained)); top["failures"] != 1.0 || top["level"] != levelWarning.String() {
+		t.Errorf("unexpected detection: %v", top)
+	}
+	if score := decode(late.waitFor(t, "homeassistant/sensor/prusalgtm_"+id+"/failure_score_top/config", retained)); score["state_topic"] != "prusalgtm/"+id+"/detection/top" {
+		t.Errorf("unexpected failure score config: %v", score)
+	}
+
+	// The broker publishes the will when the connection drops.
+	connMtx.Lock()
+	conn.Close()
+	connMtx.Unlock()
+	live.waitFor(t, "prusalgtm/"+id+"/availability", func(msg mqttMessage) bool { return msg.payload == "offline" })
+}
@@ -0,0 +1,345 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notifyRequestTimeout is the timeout of the requests of the webhook and ntfy channels.
+const notifyRequestTimeout = 30 * time.Second
+
+// webhookPayload works as is with Slack (text) and Discord (content). The other fields are for generic
+// receivers.
+type webhookPayload struct {
+	Text    string `json:"text"`
+	Content string `json:"content"`
+
+	Title      string       `json:"title"`
+	Message    string       `json:"message"`
+	Event      string       `json:"event"`
+	Printer    string       `json:"printer,omitempty"`
+	Camera     string       `json:"camera,omitempty"`
+	State      printerState `json:"state"`
+	Job        string       `json:"job,omitempty"`
+	Progress   float64      `json:"progress"`
+	Confidence float64      `json:"confidence,omitempty"`
+	Score      float64      `json:"score,omitempty"`
+	Level      string       `json:"level,omitempty"`
+	Time       time.Time    `json:"time"`
+	// Snapshot is a base64 encoded JPEG.
+	Snapshot string `json:"snapshot,omitempty"`
+}
+
+type webhookChannel struct {
+	url    string
+	format string
+	client *http.Client
+}
+
+func newWebhookChannel(url, format string) *webhookChannel {
+	return &webhookChannel{
+		url:    url,
+		format: format,
+		client: &http.Client{Timeout: notifyRequestTimeout},
+	}
+}
+
+func (w *webhookChannel) name() string {
+	// The path of a webhook URL is usually the secret.
+	if u, err := url.Parse(w.url); err == nil {
+		return "webhook:" + u.Host
+	}
+	return "webhook"
+}
+
+func (w *webhookChannel) send(ctx context.Context, n notification) error {
+	text := n.Title + "\n" + n.Message
+
+	var (
+		body        io.Reader
+		contentType string
+	)
+	if w.format == "discord" {
+		// Discord takes the message as payload_json and the snapshot as an attachment.
+		buf := new(bytes.Buffer)
+		mw := multipart.NewWriter(buf)
+
+		payload, err := json.Marshal(map[string]string{"content": text})
+		if err != nil {
+			return err
+		}
+		if err := mw.WriteField("payload_json", string(payload)); err != nil {
+			return err
+		}
+		if n.snapshot != nil {
+			part, err := mw.CreateFormFile("files[0]", "snapshot.jpg")
+			if err != nil {
+				return err
+			}
+			if _, err := part.Write(n.snapshot); err != nil {
+				return err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return err
+		}
+
+		body, contentType = buf, mw.FormDataContentType()
+	} else {
+		payload := webhookPayload{
+			Text:       text,
+			Content:    text,
+			Title:      n.Title,
+			Message:    n.Message,
+			Event:      n.Event,
+			Printer:    n.Printer,
+			Camera:     n.Camera,
+			State:      n.State,
+			Job:        n.Job,
+			Progress:   n.Progress,
+			Confidence: n.Confidence,
+			Score:      n.Score,
+			Level:      n.Level,
+			Time:       n.Time,
+		}
+		if n.snapshot != nil {
+			payload.Snapshot = base64.StdEncoding.EncodeToString(n.snapshot)
+		}
+
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body, contentType = bytes.NewReader(encoded), "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return doNotificationRequest(w.client, req)
+}
+
+type ntfyChannel struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newNtfyChannel(url, token string) *ntfyChannel {
+	return &ntfyChannel{
+		url:    url,
+		token:  token,
+		client: &http.Client{Timeout: notifyRequestTimeout},
+	}
+}
+
+func (c *ntfyChannel) name() string {
+	return "ntfy"
+}
+
+func (c *ntfyChannel) send(ctx context.Context, n notification) error {
+	// With a snapshot the body is the attachment and the message goes in a header.
+	var body io.Reader = strings.NewReader(n.Message)
+	if n.snapshot != nil {
+		body = bytes.NewReader(n.snapshot)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.url, body)
+	if err != nil {
+		return err
+	}
+	// Headers can only be ASCII, ntfy decodes RFC 2047 encoded words.
+	req.Header.Set("Title", mime.QEncoding.Encode("utf-8", n.Title))
+	if n.snapshot != nil {
+		req.Header.Set("Message", mime.QEncoding.Encode("utf-8", n.Message))
+		req.Header.Set("Filename", "snapshot.jpg")
+	}
+	req.Header.Set("Tags", n.Event)
+	if n.Event == notifyEventFailure || n.Event == string(eventJobFailed) || n.Event == string(eventJobAttention) {
+		req.Header.Set("Priority", "high")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	return doNotificationRequest(c.client, req)
+}
+
+func doNotificationRequest(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+type smtpChannel struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func (c *smtpChannel) name() string {
+	return "smtp"
+}
+
+func (c *smtpChannel) send(ctx context.Context, n notification) error {
+	msg, err := c.message(n)
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(c.host, strconv.Itoa(c.port))
+	tlsConfig := &tls.Config{ServerName: c.host}
+
+	var conn net.Conn
+	if c.port == 465 {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	// net/smtp doesn't take a context.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, c.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok && c.port != 465 {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if c.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.username, c.password, c.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(c.from); err != nil {
+		return err
+	}
+	for _, to := range c.to {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// message builds the email, with the snapshot as an attachment.
+func (c *smtpChannel) message(n notification) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	headers := []string{
+		"From: " + c.from,
+		"To: " + strings.Join(c.to, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", n.Title),
+		"Date: " + n.Time.Format(time.RFC1123Z),
+		"Message-ID: <" + hex.EncodeToString(id) + "@prusalgtm>",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=" + mw.Boundary(),
+	}
+	buf.WriteString(strings.Join(headers, "\r\n") + "\r\n\r\n")
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBase64Lines(text, []byte(n.Message)); err != nil {
+		return nil, err
+	}
+
+	if n.snapshot != nil {
+		attachment, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"image/jpeg"},
+			"Content-Disposition":       {`attachment; filename="snapshot.jpg"`},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(attachment, n.snapshot); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeBase64Lines writes data as base64 in lines of 76 characters, as email requires.
+func writeBase64Lines(w io.Writer, data []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		if _, err := io.WriteString(w, encoded[:76]+"\r\n"); err != nil {
+			return err
+		}
+		encoded = encoded[76:]
+	}
+
+	_, err := io.WriteString(w, encoded+"\r\n")
+	return err
+}
@@ -0,0 +1,443 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promNotifications = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "notifications_total",
+			Help:      "The number of notifications by channel, event and result.",
+		},
+		[]string{"channel", "event", "result", "printer"},
+	)
+)
+
+type NotifyConfig struct {
+	Events            []string      `kong:"help='The events to send notifications for.',default='failure,job_finished,job_failed,job_attention',enum='failure,failure_warning,job_started,job_paused,job_resumed,job_attention,job_finished,job_failed',name='notify-events'"`
+	MinConfidence     float64       `kong:"help='Minimum confidence of a detection for it to count towards a failure notification.',default='0.6',name='notify-min-confidence'"`
+	ConsecutiveFrames int           `kong:"help='Notify about a failure after this many consecutive frames with it.',default='3',name='notify-consecutive-frames'"`
+	DedupWindow       time.Duration `kong:"help='Do not send the same notification for the same job again for this long.',default='30m',name='notify-dedup-window'"`
+	RateLimit         int           `kong:"help='The maximum number of notifications per channel per hour. 0 disables the limit.',default='10',name='notify-rate-limit'"`
+	TitleTemplate     string        `kong:"help='The Go template of the notification title.',default='{{if .Printer}}{{.Printer}}: {{end}}{{.Summary}}',name='notify-title-template'"`
+	MessageTemplate   string        `kong:"help='The Go template of the notification message.',default='{{.Summary}}{{if .Camera}} on camera {{.Camera}}{{end}}.{{if .Job}} Job {{.Job}} at {{printf \"%.0f\" .Progress}}%.{{end}}',name='notify-message-template'"`
+
+	WebhookURLs   []string `kong:"help='Webhook URLs to post notifications to. Can be repeated.',optional,sep='none',name='notify-webhook-url'"`
+	WebhookFormat string   `kong:"help='The format of the webhook payload. json works with Slack and Discord, discord also attaches the snapshot.',default='json',enum='json,discord',name='notify-webhook-format'"`
+
+	NtfyURL       string `kong:"help='The URL of the ntfy topic to publish notifications to, eg. https://ntfy.sh/my-printer.',optional,name='notify-ntfy-url'"`
+	NtfyToken     string `kong:"help='The access token for ntfy.',optional,name='notify-ntfy-token',env='PRUSALGTM_NTFY_TOKEN'"`
+	NtfyTokenFile string `kong:"help='A file with the access token for ntfy.',optional,name='notify-ntfy-token-file',type='path'"`
+
+	SMTPHost         string   `kong:"help='The SMTP server to send notification emails through.',optional,name='notify-smtp-host'"`
+	SMTPPort         int      `kong:"help='The port of the SMTP server. 465 uses implicit TLS, other ports use STARTTLS when the server supports it.',default='587',name='notify-smtp-port'"`
+	SMTPUsername     string   `kong:"help='The username for the SMTP server.',optional,name='notify-smtp-username'"`
+	SMTPPassword     string   `kong:"help='The password for the SMTP server.',optional,name='notify-smtp-password',env='PRUSALGTM_SMTP_PASSWORD'"`
+	SMTPPasswordFile string   `kong:"help='A file with the password for the SMTP server.',optional,name='notify-smtp-password-file',type='path'"`
+	SMTPFrom         string   `kong:"help='The sender of the notification emails.',optional,name='notify-smtp-from'"`
+	SMTPTo           []string `kong:"help='The recipients of the notification emails.',optional,name='notify-smtp-to'"`
+}
+
+const (
+	notifyEventFailure        = "failure"
+	notifyEventFailureWarning = "failure_warning"
+
+	// notifySnapshotInterval is how often the snapshot of the state notifications is updated.
+	notifySnapshotInterval = 10 * time.Second
+)
+
+// notification is a single notification. The exported fields are available in the templates.
+type notification struct {
+	Event      string
+	Printer    string
+	Camera     string
+	Summary    string
+	State      printerState
+	Job        string
+	Progress   float64
+	Confidence float64
+	// Score and Level are the failure score of the job and its level, for the failure events.
+	Score float64
+	Level string
+	Time  time.Time
+
+	Title   string
+	Message string
+	// snapshot is a JPEG, nil if there is no frame yet.
+	snapshot []byte
+	// jobID tells the jobs apart for the dedup, the same file can be printed again right away. Job is only
+	// the name of the file.
+	jobID string
+}
+
+type notificationChannel interface {
+	name() string
+	send(ctx context.Context, n notification) error
+}
+
+// notifier sends notifications about confirmed failures and printer state transitions to the configured
+// channels. Notifications are sent in the background, so a slow channel doesn't hold up the cameras.
+type notifier struct {
+	cfg      NotifyConfig
+	events   map[string]bool
+	channels []notificationChannel
+	title    *template.Template
+	message  *template.Template
+	log      logger
+	queue    chan notification
+
+	// status returns the printer state, nil without a printer.
+	status func() (printerState, *printerStatus)
+
+	// The cameras of a printer share the notifier.
+	mtx    sync.Mutex
+	streak failureStreak
+	frames map[string]image.Image
+	// sent is when a notification was last sent, by event and job.
+	sent map[string]time.Time
+	// sentByChannel has the times of the notifications sent in the last hour, by channel.
+	sentByChannel map[string][]time.Time
+}
+
+// newNotifier returns nil if no channel is configured.
+func newNotifier(cfg NotifyConfig, log logger) (*notifier, error) {
+	channels, err := cfg.channels()
+	if err != nil {
+		return nil, err
+	}
+	if len(channels) == 0 {
+		return nil, nil
+	}
+
+	title, err := template.New("title").Parse(cfg.TitleTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --notify-title-template: %w", err)
+	}
+	message, err := template.New("message").Parse(cfg.MessageTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --notify-message-template: %w", err)
+	}
+
+	events := map[string]bool{}
+	for _, event := range cfg.Events {
+		events[event] = true
+	}
+
+	return &notifier{
+		cfg:           cfg,
+		events:        events,
+		channels:      channels,
+		title:         title,
+		message:       message,
+		log:           log,
+		queue:         make(chan notification, 16),
+		frames:        map[string]image.Image{},
+		sent:          map[string]time.Time{},
+		sentByChannel: map[string][]time.Time{},
+	}, nil
+}
+
+func (cfg NotifyConfig) channels() ([]notificationChannel, error) {
+	var channels []notificationChannel
+
+	for _, url := range cfg.WebhookURLs {
+		channels = append(channels, newWebhookChannel(url, cfg.WebhookFormat))
+	}
+
+	if cfg.NtfyURL != "" {
+		token, err := readSecret(cfg.NtfyToken, cfg.NtfyTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, newNtfyChannel(cfg.NtfyURL, token))
+	}
+
+	if cfg.SMTPHost != "" {
+		if cfg.SMTPFrom == "" || len(cfg.SMTPTo) == 0 {
+			return nil, fmt.Errorf("--notify-smtp-host requires --notify-smtp-from and --notify-smtp-to")
+		}
+		password, err := readSecret(cfg.SMTPPassword, cfg.SMTPPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, &smtpChannel{
+			host:     cfg.SMTPHost,
+			port:     cfg.SMTPPort,
+			username: cfg.SMTPUsername,
+			password: password,
+			from:     cfg.SMTPFrom,
+			to:       cfg.SMTPTo,
+		})
+	}
+
+	return channels, nil
+}
+
+// frameHandler returns the frame handler of the camera. The latest frame is the snapshot of the state
+// notifications.
+func (n *notifier) frameHandler(camera string) frameHandler {
+	return frameHandler{interval: everyInterval(notifySnapshotInterval), handle: func(img image.Image) {
+		n.mtx.Lock()
+		defer n.mtx.Unlock()
+
+		n.frames[camera] = img
+	}}
+}
+
+// observe sends a notification with the annotated frame once a failure is confirmed, by the streak of
+// frames with it, by the failure score becoming critical or by a failed first layer, and when the failure
+// score becomes a warning.
+func (n *notifier) observe(_ context.Context, d detection) {
+	if n.events[notifyEventFailureWarning] && d.level == levelWarning && d.previousLevel == levelOK {
+		n.notifyFailure(notifyEventFailureWarning, fmt.Sprintf("print failure warning (score %.2f)", d.score), d)
+	}
+
+	if !n.events[notifyEventFailure] {
+		return
+	}
+
+	n.mtx.Lock()
+	confirmed := n.streak.observe(d.failures, n.cfg.MinConfidence, n.cfg.ConsecutiveFrames, 0, time.Now())
+	if confirmed || d.confirmsFailure() {
+		confirmed = true
+		n.streak.reset()
+	}
+	n.mtx.Unlock()
+	if !confirmed {
+		return
+	}
+
+	if d.firstLayerFailed {
+		n.notifyFailure(notifyEventFailure, "the first layer failed the inspection", d)
+		return
+	}
+
+	confidence := 0.0
+	for _, failure := range d.failures {
+		confidence = max(confidence, failure.Confidence)
+	}
+	n.notifyFailure(notifyEventFailure, fmt.Sprintf("possible print failure (%.0f%% confidence)", confidence*100), d)
+}
+
+func (n *notifier) notifyFailure(event, summary string, d detection) {
+	confidence := 0.0
+	for _, failure := range d.failures {
+		confidence = max(confidence, failure.Confidence)
+	}
+
+	state, status := stateUnknown, (*printerStatus)(nil)
+	if n.status != nil {
+		state, status = n.status()
+	}
+
+	notif := n.newNotification(event, summary, state, status)
+	notif.Camera = d.camera
+	notif.Confidence = confidence
+	notif.Score = d.score
+	notif.Level = d.level.String()
+	n.enqueue(notif, d.annotatedAt(int(ImageSize_720p)))
+}
+
+// watch sends notifications for the printer state transitions, until events is closed.
+func (n *notifier) watch(events <-chan printerEvent) {
+	for event := range events {
+		if !n.events[string(event.Type)] {
+			continue
+		}
+
+		n.mtx.Lock()
+		var snapshot image.Image
+		for _, frame := range n.frames {
+			snapshot = frame
+			break
+		}
+		n.mtx.Unlock()
+
+		n.enqueue(n.newNotification(string(event.Type), eventSummary(event), event.To, event.Status), snapshot)
+	}
+}
+
+func eventSummary(event printerEvent) string {
+	switch event.Type {
+	case eventJobStarted:
+		return "print started"
+	case eventJobPaused:
+		return "print paused"
+	case eventJobResumed:
+		return "print resumed"
+	case eventJobAttention:
+		return "printer needs attention"
+	case eventJobFinished:
+		return "print finished"
+	case eventJobFailed:
+		if event.To == stateError {
+			return "printer error"
+		}
+		return "print stopped"
+	}
+
+	return fmt.Sprintf("printer is %s", strings.ToLower(string(event.To)))
+}
+
+func (n *notifier) newNotification(event, summary string, state printerState, status *printerStatus) notification {
+	notif := notification{
+		Event:   event,
+		Printer: n.log.printer,
+		Summary: summary,
+		State:   state,
+		Time:    time.Now(),
+	}
+	if status != nil {
+		notif.Job = status.JobName
+		notif.jobID = status.JobID
+		notif.Progress = status.Progress
+	}
+
+	return notif
+}
+
+// enqueue renders the notification and queues it, unless the same notification was sent for the same job
+// within the dedup window.
+func (n *notifier) enqueue(notif notification, snapshot image.Image) {
+	// Without a job ID from the printer the name is all there is.
+	job := notif.jobID
+	if job == "" {
+		job = notif.Job
+	}
+	key := notif.Event + "/" + job
+
+	n.mtx.Lock()
+	last, ok := n.sent[key]
+	if ok && notif.Time.Sub(last) < n.cfg.DedupWindow {
+		n.mtx.Unlock()
+		promNotifications.WithLabelValues("", notif.Event, "deduplicated", n.log.printer).Inc()
+		return
+	}
+	n.sent[key] = notif.Time
+	n.mtx.Unlock()
+
+	var err error
+	notif.Title, notif.Message, err = n.render(notif)
+	if err != nil {
+		n.log.Println("failed to render notification:", err)
+		return
+	}
+
+	if snapshot != nil {
+		notif.snapshot, err = encodeSnapshot(snapshot)
+		if err != nil {
+			n.log.Println("failed to encode notification snapshot:", err)
+		}
+	}
+
+	select {
+	case n.queue <- notif:
+	default:
+		n.log.Println("notification queue is full, dropping:", notif.Title)
+		promNotifications.WithLabelValues("", notif.Event, "dropped", n.log.printer).Inc()
+	}
+}
+
+func (n *notifier) render(notif notification) (string, string, error) {
+	title, message := new(strings.Builder), new(strings.Builder)
+	if err := n.title.Execute(title, notif); err != nil {
+		return "", "", err
+	}
+	if err := n.message.Execute(message, notif); err != nil {
+		return "", "", err
+	}
+
+	return title.String(), message.String(), nil
+}
+
+// encodeSnapshot encodes the frame as a JPEG of at most 720p, small enough for every channel.
+func encodeSnapshot(img image.Image) ([]byte, error) {
+	if img.Bounds().Dy() > int(ImageSize_720p) {
+		img = imaging.Resize(img, 0, int(ImageSize_720p), imaging.Lanczos)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := jpeg.Encode(buf, img, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// run sends the queued notifications until ctx is done.
+func (n *notifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notif := <-n.queue:
+			for _, channel := range n.channels {
+				if !n.allow(channel.name(), notif.Time) {
+					n.log.Printf("notification rate limit reached for %s, dropping: %s\n", channel.name(), notif.Title)
+					promNotifications.WithLabelValues(channel.name(), notif.Event, "rate_limited", n.log.printer).Inc()
+					continue
+				}
+
+				sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+				err := channel.send(sendCtx, notif)
+				cancel()
+				if err != nil {
+					n.log.Printf("failed to send notification to %s: %v\n", channel.name(), err)
+					promNotifications.WithLabelValues(channel.name(), notif.Event, "failed", n.log.printer).Inc()
+					continue
+				}
+				promNotifications.WithLabelValues(channel.name(), notif.Event, "sent", n.log.printer).Inc()
+			}
+		}
+	}
+}
+
+// allow returns true if the channel is under its rate limit, and counts the notification towards it.
+func (n *notifier) allow(channel string, now time.Time) bool {
+	if n.cfg.RateLimit <= 0 {
+		return true
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	recent := n.sentByChannel[channel][:0]
+	for _, sent := range n.sentByChannel[channel] {
+		if now.Sub(sent) < time.Hour {
+			recent = append(recent, sent)
+		}
+	}
+	if len(recent) >= n.cfg.RateLimit {
+		n.sentByChannel[channel] = recent
+		return false
+	}
+
+	n.sentByChannel[channel] = append(recent, now)
+	return true
+}
+
+// healthCheck reports the notifications waiting to be sent. The queue drops them once it's full.
+func (n *notifier) healthCheck() healthCheck {
+	return func() componentHealth {
+		return componentHealth{
+			Component: "notify",
+			Printer:   n.log.printer,
+			Healthy:   true,
+			Ready:     true,
+			Details:   map[string]any{"backlog": len(n.queue), "backlog_size": cap(n.queue)},
+		}
+	}
+}
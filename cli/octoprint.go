@@ -0,0 +1,229 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	promOctoPrintDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prusalgtm",
+			Name:      "octoprint_request_duration_seconds",
+			Help:      "A histogram of request latencies to the OctoPrint API.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"code", "method", "printer"},
+	)
+)
+
+// octoPrintJobEndedFor is how long the last job is reported as finished or stopped after it ended. OctoPrint
+// keeps the last job around until the next one, the printer is idle after that.
+const octoPrintJobEndedFor = 10 * time.Minute
+
+// octoPrintClient talks to the OctoPrint REST API, authenticating with an API key.
+type octoPrintClient struct {
+	url    *url.URL
+	apiKey string
+	client *http.Client
+
+	// OctoPrint doesn't have job IDs. job is the file and the start time of the job that was last seen
+	// running, and jobEnded when it was first seen ended.
+	mtx      sync.Mutex
+	job      string
+	jobEnded time.Time
+}
+
+func newOctoPrintClient(octoPrintURL *url.URL, apiKey string, log logger) *octoPrintClient {
+	return &octoPrintClient{
+		url:    octoPrintURL,
+		apiKey: apiKey,
+		client: &http.Client{
+			Timeout:   printerRequestTimeout,
+			Transport: promhttp.InstrumentRoundTripperDuration(promOctoPrintDuration.MustCurryWith(prometheus.Labels{"printer": log.printer}), http.DefaultTransport),
+		},
+	}
+}
+
+func (o *octoPrintClient) name() string {
+	return "OctoPrint"
+}
+
+func (o *octoPrintClient) status(ctx context.Context) (*printerStatus, error) {
+	var job octoPrintJob
+	if err := o.do(ctx, http.MethodGet, "/api/job", nil, &job); err != nil {
+		return nil, err
+	}
+
+	// OctoPrint returns a 409 from /api/printer when it isn't connected to the printer, which is treated
+	// like an unreachable printer.
+	var printer octoPrintPrinter
+	if err := o.do(ctx, http.MethodGet, "/api/printer", nil, &printer); err != nil {
+		return nil, err
+	}
+
+	jobID, ended := o.trackJob(printer.State.Flags, job, time.Now())
+	status := &printerStatus{
+		State:        octoPrintState(printer.State.Flags, job, ended),
+		RawState:     printer.State.Text,
+		JobID:        jobID,
+		JobName:      job.Job.File.Name,
+		TempBed:      printer.Temperature.Bed.Actual,
+		TargetBed:    printer.Temperature.Bed.Target,
+		TempNozzle:   printer.Temperature.Tool0.Actual,
+		TargetNozzle: printer.Temperature.Tool0.Target,
+	}
+	if job.Progress.Completion != nil {
+		status.Progress = *job.Progress.Completion
+	}
+	if job.Progress.PrintTime != nil {
+		status.TimePrinting = time.Duration(*job.Progress.PrintTime) * time.Second
+	}
+	if job.Progress.PrintTimeLeft != nil {
+		status.TimeRemaining = time.Duration(*job.Progress.PrintTimeLeft) * time.Second
+	}
+
+	return status, nil
+}
+
+// trackJob returns the ID of the current or last job, and true if the last job ended less than
+// octoPrintJobEndedFor ago. The ID is the file and the start time, so a reprint of the same file is a
+// new job.
+func (o *octoPrintClient) trackJob(flags octoPrintStateFlags, job octoPrintJob, now time.Time) (string, bool) {
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	active := flags.Printing || flags.Paused || flags.Pausing || flags.Resuming || flags.Cancelling || flags.Finishing
+	switch {
+	case active && (o.job == "" || !o.jobEnded.IsZero()):
+		started := now
+		if job.Progress.PrintTime != nil {
+			started = now.Add(-time.Duration(*job.Progress.PrintTime) * time.Second)
+		}
+		o.job = fmt.Sprintf("%s@%s", job.Job.File.Path, started.UTC().Format(time.RFC3339))
+		o.jobEnded = time.Time{}
+	case !active && o.job != "" && o.jobEnded.IsZero():
+		o.jobEnded = now
+	case !active && o.job != "" && now.Sub(o.jobEnded) >= octoPrintJobEndedFor:
+		o.job = ""
+	}
+
+	return o.job, !active && o.job != ""
+}
+
+// octoPrintState maps the OctoPrint state flags into a printer state. OctoPrint has no finished or stopped
+// state, so they are derived from the progress of the last job while it ended recently.
+func octoPrintState(flags octoPrintStateFlags, job octoPrintJob, ended bool) printerState {
+	switch {
+	case flags.Error:
+		return stateError
+	case flags.Paused || flags.Pausing:
+		return statePaused
+	case flags.Printing || flags.Resuming:
+		return statePrinting
+	case flags.Cancelling || flags.Finishing:
+		return stateBusy
+	case flags.Operational && ended && job.Job.File.Name != "" && job.Progress.Completion != nil:
+		if *job.Progress.Completion >= 100 {
+			return stateFinished
+		}
+		if *job.Progress.Completion > 0 {
+			return stateStopped
+		}
+		return stateIdle
+	case flags.Operational:
+		return stateIdle
+	}
+
+	return stateUnknown
+}
+
+func (o *octoPrintClient) pauseJob(ctx context.Context, _ string) error {
+	body, err := json.Marshal(map[string]string{"command": "pause", "action": "pause"})
+	if err != nil {
+		return err
+	}
+
+	return o.do(ctx, http.MethodPost, "/api/job", body, nil)
+}
+
+// do sends the request and decodes the response into v if it isn't nil.
+func (o *octoPrintClient) do(ctx context.Context, method, path string, body []byte, v any) error {
+	req, err := http.NewRequestWithContext(ctx, method, o.url.JoinPath(path).String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Api-Key", o.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OctoPrint %s %s failed. status: %s", method, path, resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type octoPrintJob struct {
+	Job struct {
+		File struct {
+			Name string `json:"name"`
+			Path string `json:"path"`
+		} `json:"file"`
+	} `json:"job"`
+	Progress struct {
+		Completion    *float64 `json:"completion"`
+		PrintTime     *int     `json:"printTime"`
+		PrintTimeLeft *int     `json:"printTimeLeft"`
+	} `json:"progress"`
+	State string `json:"state"`
+}
+
+type octoPrintStateFlags struct {
+	Operational   bool `json:"operational"`
+	Paused        bool `json:"paused"`
+	Printing      bool `json:"printing"`
+	Pausing       bool `json:"pausing"`
+	Resuming      bool `json:"resuming"`
+	Cancelling    bool `json:"cancelling"`
+	Finishing     bool `json:"finishing"`
+	Error         bool `json:"error"`
+	Ready         bool `json:"ready"`
+	ClosedOrError bool `json:"closedOrError"`
+}
+
+type octoPrintTemperature struct {
+	Actual float64 `json:"actual"`
+	Target float64 `json:"target"`
+}
+
+type octoPrintPrinter struct {
+	Temperature struct {
+		Tool0 octoPrintTemperature `json:"tool0"`
+		Bed   octoPrintTemperature `json:"bed"`
+	} `json:"temperature"`
+	State struct {
+		Text  string              `json:"text"`
+		Flags octoPrintStateFlags `json:"flags"`
+	} `json:"state"`
+}
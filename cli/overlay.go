@@ -0,0 +1,172 @@
+package cli
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/fogleman/gg"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/opentype"
+)
+
+// overlayFont is parsed once, the faces of every size come from it.
+var overlayFont = sync.OnceValues(func() (*opentype.Font, error) {
+	return opentype.Parse(gobold.TTF)
+})
+
+func overlayFace(size float64) (font.Face, error) {
+	f, err := overlayFont()
+	if err != nil {
+		return nil, err
+	}
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// overlay draws the detections, and the status of the printer, on the frames.
+type overlay struct {
+	detectionCfg DetectionConfig
+
+	// withStatus writes the status text, and status returns the printer state for it, nil without a
+	// printer. They are set by print-image before the detector is used.
+	withStatus bool
+	status     func() (printerState, *printerStatus)
+}
+
+// draw returns the frame resized to at most height pixels, or at its size with 0, with the failures drawn on
+// it. The overlays are drawn after resizing and sized relative to the output, so they are as legible on a
+// 480p snapshot as on the full frame. The boxes are the colour of the level of their own confidence.
+func (o *overlay) draw(img image.Image, height int, failures []detectedFailure, captured time.Time) image.Image {
+	scale := 1.0
+	if height > 0 && img.Bounds().Dy() > height {
+		scale = float64(height) / float64(img.Bounds().Dy())
+		img = imaging.Resize(img, 0, height, imaging.Lanczos)
+	}
+
+	var status []string
+	if o.withStatus {
+		status = o.statusLines(captured)
+	}
+	if len(failures) == 0 && len(status) == 0 {
+		return img
+	}
+
+	ggCtx := gg.NewContextForImage(img)
+	// A unit is a pixel at 480p.
+	unit := max(float64(ggCtx.Height())/480, 1)
+	face, err := overlayFace(11 * unit)
+	if err == nil {
+		ggCtx.SetFontFace(face)
+	}
+
+	ggCtx.SetLineWidth(2 * unit)
+	for _, failure := range failures {
+		c := o.detectionCfg.level(failure.Confidence).color()
+
+		// It's the x, y (of the center of the box), width, height
+		w := failure.BoxCoordinates[2] * scale
+		h := failure.BoxCoordinates[3] * scale
+		x := failure.BoxCoordinates[0]*scale - w/2
+		y := failure.BoxCoordinates[1]*scale - h/2
+
+		ggCtx.SetColor(c)
+		ggCtx.DrawRectangle(x, y, w, h)
+		ggCtx.Stroke()
+
+		if o.detectionCfg.OverlayLabels {
+			label := fmt.Sprintf("%s %.0f%%", failure.label(), failure.Confidence*100)
+			// Aligned with the outside of the line.
+			drawLabel(ggCtx, label, x-unit, y-unit, c, unit)
+		}
+	}
+
+	if len(status) > 0 {
+		drawStatus(ggCtx, status, unit)
+	}
+
+	return ggCtx.Image()
+}
+
+// drawLabel writes the label on a background of the colour of the box, above its top left corner, or
+// inside the box when it's at the top of the frame.
+func drawLabel(ggCtx *gg.Context, label string, x, y float64, c color.Color, unit float64) {
+	padding := 2 * unit
+	tw, th := ggCtx.MeasureString(label)
+	lw, lh := tw+2*padding, th+2*padding
+
+	x = min(max(x, 0), float64(ggCtx.Width())-lw)
+	if y-lh >= 0 {
+		y -= lh
+	} else {
+		y = max(y, 0)
+	}
+
+	ggCtx.SetColor(c)
+	ggCtx.DrawRectangle(x, y, lw, lh)
+	ggCtx.Fill()
+
+	ggCtx.SetColor(textColor(c))
+	ggCtx.DrawStringAnchored(label, x+padding, y+lh/2, 0, 0.35)
+}
+
+// textColor returns black or white, whichever reads better on the background.
+func textColor(background color.Color) color.Color {
+	r, g, b, _ := background.RGBA()
+	if 0.299*float64(r)+0.587*float64(g)+0.114*float64(b) > 0.5*0xffff {
+		return color.Black
+	}
+	return color.White
+}
+
+// drawStatus writes the lines of the status at the bottom left of the frame, on a dark background.
+func drawStatus(ggCtx *gg.Context, lines []string, unit float64) {
+	padding := 4 * unit
+	lineHeight := ggCtx.FontHeight() * 1.4
+
+	width := 0.0
+	for _, line := range lines {
+		w, _ := ggCtx.MeasureString(line)
+		width = max(width, w)
+	}
+	height := lineHeight * float64(len(lines))
+
+	y := float64(ggCtx.Height()) - height - 2*padding
+	ggCtx.SetColor(color.NRGBA{0, 0, 0, 160})
+	ggCtx.DrawRectangle(0, y, width+2*padding, height+2*padding)
+	ggCtx.Fill()
+
+	ggCtx.SetColor(color.White)
+	for i, line := range lines {
+		ggCtx.DrawStringAnchored(line, padding, y+padding+lineHeight*(float64(i)+0.5), 0, 0.35)
+	}
+}
+
+// statusLines returns the time of the frame, and the job, progress and temperatures of the printer when it
+// has a job.
+func (o *overlay) statusLines(captured time.Time) []string {
+	lines := []string{captured.Format("2006-01-02 15:04:05")}
+	if o.status == nil {
+		return lines
+	}
+
+	state, status := o.status()
+	if status == nil {
+		return append(lines, string(state))
+	}
+
+	if status.JobName != "" {
+		lines = append(lines, fmt.Sprintf("%s %.0f%%", status.JobName, status.Progress))
+	} else {
+		lines = append(lines, string(state))
+	}
+
+	temps := fmt.Sprintf("Nozzle %.0f/%.0f°C  Bed %.0f/%.0f°C", status.TempNozzle, status.TargetNozzle, status.TempBed, status.TargetBed)
+	if status.HasAxisZ {
+		temps += fmt.Sprintf("  Z %.2fmm", status.AxisZ)
+	}
+	return append(lines, temps)
+}
@@ -2,21 +2,20 @@ package cli
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"image"
 	"image/jpeg"
 	"net/http"
 	"net/url"
+	"slices"
 	"time"
 
 	"github.com/disintegration/imaging"
 	"github.com/gouthamve/prusaLGTM/camera"
-	"github.com/icholy/digest"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const (
@@ -36,111 +35,545 @@ var (
 			Name:      "images_logged_total",
 			Help:      "The number of images logged.",
 		},
-		[]string{"pixels_size"},
+		[]string{"pixels_size", "printer", "camera"},
 	)
-	promImagesLoggedSize = promauto.NewHistogram(prometheus.HistogramOpts{
-		Namespace: "prusalgtm",
-		Name:      "images_logged_size_bytes",
-		Help:      "The size of the images logged.",
-		Buckets:   prometheus.DefBuckets,
-	})
-
-	promPrusaLinkDuration = promauto.NewHistogramVec(
+	promImagesLoggedSize = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Namespace: "prusalgtm",
-			Name:      "prusalink_request_duration_seconds",
-			Help:      "A histogram of request latencies to the PrusaLink API.",
+			Name:      "images_logged_size_bytes",
+			Help:      "The size of the images logged.",
 			Buckets:   prometheus.DefBuckets,
 		},
-		[]string{"code", "method"},
+		[]string{"printer", "camera"},
 	)
 )
 
 type ImageSize int
 
+var validImageSizes = []ImageSize{ImageSize_1080p, ImageSize_720p, ImageSize_480p, ImageSize_360p, ImageSize_240p}
+
+func isValidImageSize(size ImageSize) bool {
+	for _, valid := range validImageSizes {
+		if size == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
 type PrintConfig struct {
 	MaxLogSize   int       `kong:"help='Maximum bytes of the image to be logged. Set it to lower than Loki log line limit',default='256000',name='max-log-size'"`
 	MaxImageSize ImageSize `kong:"help='Maximum size of the image to be logged in pixels.',default='1080',name='max-image-size',enum='1080,720,480,360,240'"`
 
-	// Need to migrate to a proper config file at this point. But delaying it with a hack. The auth is using http digest, but here I am specifying basic auth, and then changing it later.
-	PrusaLinkURL *url.URL `kong:"help='The URL to PrusaLink. When provided we only log images when there is a print job ongoing.',default='',name='prusa-link-url',optional"`
-
 	// Add ML API support.
-	MLAPIURL string `kong:"help='EXPERIMENTAL: The URL to the ML API to detect failures.',optional,name='ml-api-url'"`
+	MLAPIURL        string `kong:"help='EXPERIMENTAL: The URL to the ML API to detect failures.',optional,name='ml-api-url'"`
+	DetectQueueSize int    `kong:"help='The number of frames of a camera that can wait for the ML API. The oldest frame is dropped when more arrive.',default='1',name='detect-queue-size'"`
+	OverlayStatus   bool   `kong:"help='Write the time, and the job, progress and temperatures of the printer, on the frames with the detections drawn on them.',name='overlay-status'"`
+	MLClientConfig
+	HeuristicConfig
+	DetectionConfig
+	DatasetExportConfig
 }
 
 type printImage struct {
 	PrintConfig
+	PrinterConfig
+	AutoPauseConfig
+	FirstLayerConfig
+	CapturePolicyConfig
+	StreamConfig
+	HealthConfig
+	PrusaConnectConfig
+	MQTTConfig
+	NotifyConfig
+	AlertmanagerConfig
 
 	camera.CameraConfig
+
+	PrinterName string `kong:"help='The printer section of the config file to use. Not needed if there is only one.',optional,name='printer'"`
+
+	live *liveConfig
+	log  logger
+	// overlay draws on the frames that went through the detection workers: the overlay of the detector, or
+	// one of its own when only the first layer is inspected.
+	overlay *overlay
+	// views are the live views of the cameras by name. They outlive run, so that a restarted pipeline keeps
+	// serving on the same paths.
+	views map[string]*liveView
+}
+
+// namedCamera is one of the cameras of a printer. The name is empty when the printer has a single camera.
+type namedCamera struct {
+	name         string
+	config       camera.CameraConfig
+	prusaConnect PrusaConnectConfig
 }
 
-func (p *printImage) Run() error {
-	cam, err := camera.NewCamera(p.CameraConfig)
+// namedCamera returns the camera configured by the flags.
+func (p *printImage) namedCamera() namedCamera {
+	return namedCamera{
+		config:       p.CameraConfig,
+		prusaConnect: p.PrusaConnectConfig,
+	}
+}
+
+func (p *printImage) Run(ctx context.Context) error {
+	p.live = newLiveConfig(p.liveSettings())
+	p.log = newLogger(p.PrinterName, "")
+
+	cameras := []namedCamera{p.namedCamera()}
+	if PrusaLGTM.ConfigFile != "" {
+		cfg, err := loadConfigFile(string(PrusaLGTM.ConfigFile))
+		if err != nil {
+			return err
+		}
+
+		printer, err := cfg.selectPrinter(p.PrinterName)
+		if err != nil {
+			return err
+		}
+		if printer != "" {
+			cameras, err = cfg.printerCameras(printer, p.namedCamera())
+			if err != nil {
+				return err
+			}
+		}
+
+		reloadCtx, stopReloading := context.WithCancel(ctx)
+		defer stopReloading()
+		go reloadOnSIGHUP(reloadCtx, func() error {
+			root, err := reloadConfig()
+			if err != nil {
+				return err
+			}
+
+			p.live.set(root.PrintImage.liveSettings())
+			return nil
+		})
+	}
+
+	return p.run(ctx, cameras)
+}
+
+// run runs the pipeline of the printer: the printer poller, the detector and a capture loop per camera. It
+// returns when ctx is done or one of the cameras fails, after stopping the others. Stopping because ctx is
+// done isn't an error.
+func (p *printImage) run(ctx context.Context, cameras []namedCamera) error {
+	var (
+		detector *failureDetector
+		err      error
+	)
+	if p.MLAPIURL != "" || p.Detector == detectorHeuristic {
+		if p.WarningThreshold > p.CriticalThreshold {
+			return fmt.Errorf("--detect-warning-threshold must not be above --detect-critical-threshold")
+		}
+		detector, err = newFailureDetector(p.MLAPIURL, p.MLClientConfig, p.HeuristicConfig, p.DetectionConfig, p.log)
+		if err != nil {
+			return err
+		}
+		detector.overlay.withStatus = p.OverlayStatus
+		p.overlay = detector.overlay
+		// The heuristics have no service to check.
+		if detector.heuristics == nil {
+			defer healthChecks.add(detectorHealthCheck(detector))()
+		}
+	}
+
+	printer, err := newPrinterBackend(p.PrinterConfig, p.log)
 	if err != nil {
 		return err
 	}
-	defer cam.Close()
 
-	var detector *failureDetector
-	if p.MLAPIURL != "" {
-		detector, err = newFailureDetector(p.MLAPIURL)
+	if p.AutoPauseConfig.Enabled && (printer == nil || detector == nil) {
+		return fmt.Errorf("--auto-pause requires a printer URL and --ml-api-url or --detector=heuristic")
+	}
+	// The first layer is inspected by the detection workers, and needs the Z height of the printer. It
+	// doesn't need the detector.
+	if p.FirstLayerConfig.Enabled && printer == nil {
+		return fmt.Errorf("--first-layer-inspect requires a printer URL")
+	}
+	if detector == nil {
+		p.overlay = &overlay{detectionCfg: p.DetectionConfig, withStatus: p.OverlayStatus}
+	}
+	// The frames go through the detection workers for the detector, the first layer inspector or both.
+	detecting := detector != nil || p.FirstLayerConfig.Enabled
+
+	cams := make([]*camera.Camera, 0, len(cameras))
+	for _, c := range cameras {
+		cam, err := camera.NewCamera(c.config)
 		if err != nil {
 			return err
 		}
+		defer cam.Close()
+
+		log := newLogger(p.PrinterName, c.name)
+		defer healthChecks.add(cameraHealthCheck(cam, log, p.StaleAfter))()
+
+		cams = append(cams, cam)
+	}
+
+	sinkCtx, stopSinks := context.WithCancel(ctx)
+	defer stopSinks()
+
+	var observers []detectionObserver
+
+	cameraNames := make([]string, len(cameras))
+	for i, c := range cameras {
+		cameraNames[i] = c.name
+	}
+	publisher, err := newMQTTPublisher(p.MQTTConfig, cameraNames, p.log)
+	if err != nil {
+		return err
+	}
+	if publisher != nil {
+		defer publisher.close()
+		defer healthChecks.add(publisher.healthCheck())()
+		observers = append(observers, publisher)
+	}
+
+	notifier, err := newNotifier(p.NotifyConfig, p.log)
+	if err != nil {
+		return err
+	}
+	if notifier != nil {
+		defer healthChecks.add(notifier.healthCheck())()
+		go notifier.run(sinkCtx)
+		if detecting {
+			observers = append(observers, notifier)
+		}
+	}
+
+	alerter, err := p.newAlerter(cameras, cams)
+	if err != nil {
+		return err
+	}
+	if alerter != nil {
+		defer healthChecks.add(alerter.healthCheck())()
+		go alerter.run(sinkCtx)
+		if detecting {
+			observers = append(observers, alerter)
+		}
 	}
 
-	if p.PrusaLinkURL == nil {
-		pictures, err := cam.Start()
+	exporter, err := newDatasetExporter(p.DatasetExportConfig)
+	if err != nil {
+		return err
+	}
+	if exporter != nil && detector != nil {
+		observers = append(observers, exportObserver{exporter: exporter, printer: p.PrinterName})
+		go exporter.run(sinkCtx, p.log)
+		defer func() {
+			if err := exporter.flush(); err != nil {
+				p.log.Println("failed to save the exported labels:", err)
+			}
+		}()
+	}
+
+	views := make([]*liveView, len(cams))
+	for i, cam := range cams {
+		handlers := &frameHandlers{}
+
+		if p.StreamConfig.Enabled {
+			views[i], err = p.liveView(cameras[i].name)
+			if err != nil {
+				return err
+			}
+			handlers.add(views[i].frameHandler())
+		}
+
+		sink, err := newPrusaConnectSink(cameras[i].prusaConnect, newLogger(p.PrinterName, cameras[i].name))
 		if err != nil {
 			return err
 		}
-		defer cam.Stop()
-		return p.logImages(pictures, detector)
+		if sink != nil {
+			defer healthChecks.add(sink.healthCheck())()
+			handlers.add(sink.frameHandler())
+			go sink.run(sinkCtx)
+		}
+
+		if publisher != nil && p.MQTTConfig.SnapshotInterval > 0 {
+			handlers.add(publisher.frameHandler(cameras[i].name))
+		}
+		if notifier != nil {
+			handlers.add(notifier.frameHandler(cameras[i].name))
+		}
+		if alerter != nil && p.AlertmanagerConfig.DarkThreshold > 0 {
+			handlers.add(alerter.frameHandler(cameras[i].name))
+		}
+
+		if len(handlers.handlers) > 0 {
+			cam.SetFrameHandler(handlers.handle, handlers.interval)
+		}
 	}
 
-	shouldLogImagesCh := make(chan bool)
-	defer close(shouldLogImagesCh)
+	errs := make(chan error, len(cams))
 
-	go func() {
-		// Call the PrusaLink API every 5 seconds to get the print status.
-		timer := time.NewTicker(5 * time.Second)
-		defer timer.Stop()
+	if printer == nil {
+		if publisher != nil {
+			go publisher.run(sinkCtx, nil, p.PollInterval)
+		}
 
-		for range timer.C {
-			isPrinting, err := isPrinterPrinting(p.PrusaLinkURL)
+		for i, cam := range cams {
+			pictures, err := cam.Start()
 			if err != nil {
-				fmt.Println(err)
-				continue
+				return err
 			}
+			defer cam.Stop()
+
+			log := newLogger(p.PrinterName, cameras[i].name)
+			rule := newActiveCaptureRule(captureRule{Detect: true})
+			// Without a printer there are no jobs, the score covers everything since the start.
+			score := newFailureScore(p.DetectionConfig, log)
+			go func() {
+				errs <- p.logImages(ctx, pictures, rule, detector, nil, score, observers, views[i], log)
+			}()
+		}
 
-			shouldLogImagesCh <- isPrinting
+		select {
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return nil
 		}
+	}
+
+	// The pauser checks if it's enabled on every frame, so that auto-pause can be turned on by a reload.
+	if detecting {
+		observers = append(observers, newAutoPauser(p.live, printer, p.FirstLayerConfig.Pause, p.log))
+	}
+
+	tracker := newPrinterStateTracker(p.DebouncePolls, p.UnreachablePolls, p.log)
+	defer healthChecks.add(printerHealthCheck(tracker, printer, p.PollInterval, p.StaleAfter))()
+
+	if publisher != nil {
+		go publisher.run(sinkCtx, tracker, p.PollInterval)
+	}
+	if notifier != nil {
+		notifier.status = tracker.current
+		go notifier.watch(tracker.subscribe())
+	}
+	if detector != nil {
+		detector.setPrinterStatus(tracker.current)
+	} else {
+		p.overlay.status = tracker.current
+	}
+	if alerter != nil {
+		go alerter.watch(tracker.subscribe())
+	}
+
+	for i, cam := range cams {
+		events := tracker.subscribe()
+		log := newLogger(p.PrinterName, cameras[i].name)
+		go func() {
+			errs <- p.logImagesWhenPrinting(ctx, cam, events, tracker, detector, observers, views[i], log)
+		}()
+	}
+
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	pollingDone := make(chan struct{})
+	go func() {
+		defer close(pollingDone)
+		tracker.poll(pollCtx, printer, p.PollInterval)
 	}()
 
-	return p.logImagesWhenPrinting(cam, shouldLogImagesCh, detector)
+	running := len(cams)
+	select {
+	case err = <-errs:
+		running--
+	case <-ctx.Done():
+	}
+
+	// Closing the tracker stops the cameras.
+	stopPolling()
+	<-pollingDone
+	tracker.close()
+	for ; running > 0; running-- {
+		<-errs
+	}
+
+	return err
+}
+
+// newAlerter returns the alerter of the cameras, with links to their snapshots if they are served.
+func (p *printImage) newAlerter(cameras []namedCamera, cams []*camera.Camera) (*alerter, error) {
+	byName := make(map[string]*camera.Camera, len(cams))
+	snapshotURLs := map[string]string{}
+	for i, cam := range cams {
+		byName[cameras[i].name] = cam
+		if p.StreamConfig.Enabled && p.AlertmanagerConfig.ExternalURL != "" {
+			snapshotURL, err := url.JoinPath(p.AlertmanagerConfig.ExternalURL, liveViewPrefix(p.PrinterName, cameras[i].name), "snapshot.jpg")
+			if err != nil {
+				return nil, fmt.Errorf("invalid --alertmanager-external-url: %w", err)
+			}
+			snapshotURLs[cameras[i].name] = snapshotURL
+		}
+	}
+
+	return newAlerter(p.AlertmanagerConfig, byName, snapshotURLs, p.StaleAfter, p.log)
 }
 
-func (p *printImage) logImages(pictures <-chan image.Image, detector *failureDetector) error {
-	maxImageBytes := p.PrintConfig.MaxLogSize - len(formatString)
+// liveView returns the live view of the camera, and registers its endpoints the first time. The endpoints
+// are under the names of the printer and the camera, if they have one.
+func (p *printImage) liveView(cameraName string) (*liveView, error) {
+	if view, ok := p.views[cameraName]; ok {
+		return view, nil
+	}
+
+	password, err := readSecret(p.StreamConfig.Password, p.StreamConfig.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := liveViewPrefix(p.PrinterName, cameraName)
+	log := newLogger(p.PrinterName, cameraName)
+	view := newLiveView(log)
+	view.register(http.DefaultServeMux, prefix, p.StreamConfig.Username, password)
+	log.Printf("serving %s/snapshot.jpg and %s/stream.mjpg\n", prefix, prefix)
+
+	if p.views == nil {
+		p.views = map[string]*liveView{}
+	}
+	p.views[cameraName] = view
+
+	return view, nil
+}
+
+// detection is the result of running the detector on a frame of a camera.
+type detection struct {
+	camera string
+	// frame is the frame the detector saw, and captured the time it was captured.
+	frame    image.Image
+	captured time.Time
+	// detected is false for a frame that only went to the first layer inspector, and has no failures.
+	detected bool
+	overlay  *overlay
+	failures []detectedFailure
+	// defects are the defects the first layer inspector found in the frame. They are only drawn on the
+	// frame: the first layer confirms a failure through firstLayerFailed, not through the failures.
+	defects []detectedFailure
+	// score is the smoothed failure score of the job after this frame, and level its level. previousLevel
+	// is the level before this frame, to act on the transitions.
+	score         float64
+	level         failureLevel
+	previousLevel failureLevel
+	// firstLayerFailed is true for the frame that failed the inspection of the first layer.
+	firstLayerFailed bool
+}
+
+// annotatedAt returns the frame resized to at most height pixels with the failures drawn on it, 0 keeps the
+// size of the frame. Smaller copies of the frame are drawn on after resizing, so the overlays stay legible.
+// The frames are drawn on where they are used, at the size they are used at.
+func (d detection) annotatedAt(height int) image.Image {
+	return d.overlay.draw(d.frame, height, append(slices.Clip(d.failures), d.defects...), d.captured)
+}
+
+// becameCritical is true for the frame that took the score to the critical level.
+func (d detection) becameCritical() bool {
+	return d.level == levelCritical && d.previousLevel != levelCritical
+}
+
+// confirmsFailure is true for the frames that confirm a failure on their own, without a streak of frames
+// with it: the one that took the score to critical, and the one that failed the first layer.
+func (d detection) confirmsFailure() bool {
+	return d.becameCritical() || d.firstLayerFailed
+}
+
+// detectionObserver is told about every frame that went through the detector.
+type detectionObserver interface {
+	observe(ctx context.Context, d detection)
+}
+
+// frameHandler gets the frames of a camera between the pictures. Converting a frame costs a lot of CPU on
+// a Pi, so the handler says how often it needs one.
+type frameHandler struct {
+	handle func(image.Image)
+	// interval returns the minimum time between the frames the handler needs, 0 for every frame.
+	interval func() time.Duration
+}
+
+// frameHandlerSlack is how much earlier than its interval a handler takes a frame. The frames, and the
+// time it takes to convert them, don't come exactly on time.
+const frameHandlerSlack = 100 * time.Millisecond
+
+// everyInterval returns the interval func of a handler that needs a frame every interval.
+func everyInterval(interval time.Duration) func() time.Duration {
+	return func() time.Duration { return interval }
+}
+
+// frameHandlers is the frame handler of a camera that sends the frames to the handlers that are due one.
+// It's only used from the loop of the camera.
+type frameHandlers struct {
+	handlers []frameHandler
+	last     []time.Time
+}
+
+func (h *frameHandlers) add(handler frameHandler) {
+	h.handlers = append(h.handlers, handler)
+	h.last = append(h.last, time.Time{})
+}
 
-	validSizes := []ImageSize{ImageSize_1080p, ImageSize_720p, ImageSize_480p, ImageSize_360p, ImageSize_240p}
-	for _, size := range validSizes {
-		if size <= p.PrintConfig.MaxImageSize {
-			break
+// interval is the interval of the handler that needs frames most often.
+func (h *frameHandlers) interval() time.Duration {
+	interval := time.Duration(-1)
+	for _, handler := range h.handlers {
+		if i := handler.interval(); interval < 0 || i < interval {
+			interval = i
 		}
+	}
+	return max(interval, 0)
+}
+
+func (h *frameHandlers) handle(img image.Image) {
+	now := time.Now()
+	for i, handler := range h.handlers {
+		if now.Sub(h.last[i]) >= handler.interval()-frameHandlerSlack {
+			handler.handle(img)
+			h.last[i] = now
+		}
+	}
+}
 
-		validSizes = validSizes[1:]
+// liveViewPrefix returns the path of the live view endpoints of the camera.
+func liveViewPrefix(printer, camera string) string {
+	prefix := ""
+	for _, name := range []string{printer, camera} {
+		if name != "" {
+			prefix += "/" + name
+		}
+	}
+
+	return prefix
+}
+
+// logImages logs the frames at the size allowed by the capture rule, and queues them for the detector. The
+// detector runs in the background, so the frames are logged without the detections on them.
+func (p *printImage) logImages(ctx context.Context, pictures <-chan image.Image, rule *activeCaptureRule, detector *failureDetector, inspector *firstLayerInspector, score *failureScore, observers []detectionObserver, view *liveView, log logger) error {
+	var worker *detectionWorker
+	if detector != nil || inspector != nil {
+		worker = newDetectionWorker(detector, p.overlay, inspector, score, observers, view, p.DetectQueueSize, log)
+		defer worker.close()
+		defer healthChecks.add(worker.healthCheck())()
+		go worker.run(ctx)
 	}
 
 	for img := range pictures {
-		if detector != nil {
-			image, _, err := detector.DetectFailure(img)
-			if err != nil {
-				fmt.Println("detection failure", err)
-			} else {
-				img = image
+		settings := p.live.get()
+		maxImageBytes := settings.MaxLogSize - len(log.prefix) - len(formatString)
+		currentRule := rule.get().withDefaults(0, settings.MaxImageSize)
+
+		validSizes := validImageSizes
+		for _, size := range validSizes {
+			if size <= currentRule.MaxImageSize {
+				break
 			}
+
+			validSizes = validSizes[1:]
+		}
+
+		detect := currentRule.Detect && detector != nil
+		if worker != nil && (detect || inspector != nil && inspector.wantsFrames()) {
+			worker.enqueue(img, detect)
 		}
 
 		for _, size := range validSizes {
@@ -154,10 +587,10 @@ func (p *printImage) logImages(pictures <-chan image.Image, detector *failureDet
 			toPrint := formatString + base64.StdEncoding.EncodeToString(buf.Bytes())
 
 			if len(toPrint) < maxImageBytes {
-				fmt.Println(toPrint)
-				promImagesLoggedSize.Observe(float64(len(buf.Bytes())))
+				log.Println(toPrint)
+				promImagesLoggedSize.WithLabelValues(log.printer, log.camera).Observe(float64(len(buf.Bytes())))
 
-				promImagesLogged.WithLabelValues(fmt.Sprintf("%d", size)).Inc()
+				promImagesLogged.WithLabelValues(fmt.Sprintf("%d", size), log.printer, log.camera).Inc()
 				break
 			}
 		}
@@ -166,92 +599,100 @@ func (p *printImage) logImages(pictures <-chan image.Image, detector *failureDet
 	return nil
 }
 
-func (p *printImage) logImagesWhenPrinting(cam *camera.Camera, shouldLogImagesCh <-chan bool, detector *failureDetector) error {
+// logImagesWhenPrinting starts and stops the camera, and changes how often and at what size the frames
+// are logged, based on the printer state and the capture policy. It returns when events is closed.
+func (p *printImage) logImagesWhenPrinting(ctx context.Context, cam *camera.Camera, events <-chan printerEvent, tracker *printerStateTracker, detector *failureDetector, observers []detectionObserver, view *liveView, log logger) error {
+	// The policy also depends on the Z height and the time since the job finished, so re-evaluate it on
+	// every poll and not just on state transitions.
+	ticker := time.NewTicker(p.PollInterval)
+	defer ticker.Stop()
+
 	isLogging := false
+	var finishedAt time.Time
+	rule := newActiveCaptureRule(captureRule{})
+	layers := newLayerChangeDetector()
+	score := newFailureScore(p.DetectionConfig, log)
+	inspector := newFirstLayerInspector(p.FirstLayerConfig, p.DetectionConfig, func() CapturePolicyConfig { return p.live.get().CapturePolicy }, tracker.current, log)
+	var lastStatus *printerStatus
+	// logErrs gets the result of logImages. It's replaced every time the camera starts, so a logImages that
+	// returns after the camera stopped doesn't block.
+	var logErrs chan error
+
+	for {
+		select {
+		case err := <-logErrs:
+			if err == nil {
+				// The camera was stopped.
+				continue
+			}
+			// The camera blocks on the next picture once nothing reads them, so it can't keep running.
+			log.Println(err, "error logging images")
+			if stopErr := cam.Stop(); stopErr != nil {
+				log.Println(stopErr, "error stopping camera")
+			}
+			return err
+		case event, ok := <-events:
+			if !ok {
+				if isLogging {
+					return cam.Stop()
+				}
+				return nil
+			}
+			switch event.Type {
+			case eventJobStarted:
+				layers.reset()
+				score.reset()
+			case eventJobFinished:
+				finishedAt = event.Time
+			}
+		case <-ticker.C:
+		}
+
+		policy := p.live.get().CapturePolicy
+		state, status := tracker.current()
+		newRule, shouldLog := policy.ruleFor(state, status, finishedAt)
+		newRule = newRule.withDefaults(p.PictureInterval, 0)
+
+		if shouldLog && newRule != rule.get() {
+			log.Printf("capture settings changed to %s in state %s\n", newRule, state)
+			rule.set(newRule)
+			cam.SetPictureInterval(newRule.pictureInterval())
+		}
 
-	for shouldLog := range shouldLogImagesCh {
 		if shouldLog && !isLogging {
 			pictures, err := cam.Start()
 			if err != nil {
-				fmt.Println(err, "error starting camera")
+				log.Println(err, "error starting camera")
 				return err
 			}
 
 			isLogging = true
 
-			go p.logImages(pictures, detector)
+			logErrs = make(chan error, 1)
+			go func(errs chan<- error) {
+				errs <- p.logImages(ctx, pictures, rule, detector, inspector, score, observers, view, log)
+			}(logErrs)
 
 		} else if !shouldLog && isLogging {
 			if err := cam.Stop(); err != nil {
-				fmt.Println(err, "error stopping camera")
+				log.Println(err, "error stopping camera")
 				return err
 			}
 
 			isLogging = false
 		}
-	}
-
-	return nil
-}
-
-func isPrinterPrinting(prusaLinkURL *url.URL) (bool, error) {
-	statusURL := prusaLinkURL.JoinPath("/api/v1/status")
-	username := prusaLinkURL.User.Username()
-	password, _ := prusaLinkURL.User.Password()
-
-	client := &http.Client{
-		Transport: &digest.Transport{
-			Username: username,
-			Password: password,
-		},
-	}
-	client.Transport = promhttp.InstrumentRoundTripperDuration(promPrusaLinkDuration, client.Transport)
-	statusURL.User = nil
-
-	// Call the PrusaLink API to get the print status.
-	resp, err := client.Get(statusURL.String())
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
 
-	var status Status
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-		return false, err
-	}
+		// Only look at the Z height of new polls, otherwise the same poll could count as two checks.
+		if shouldLog && newRule.Layer && status != nil && status.HasAxisZ && status != lastStatus {
+			if layers.observe(status.AxisZ, policy.LayerMinStep) {
+				time.AfterFunc(policy.LayerDelay, cam.Trigger)
+			}
+		}
+		lastStatus = status
 
-	if status.Printer.State == "PRINTING" || status.Printer.State == "PAUSED" || status.Printer.State == "ATTENTION" {
-		return true, nil
-	}
-	if status.Printer.State != "OPERATIONAL" && status.Printer.State != "FINISHED" && status.Printer.State != "IDLE" {
-		fmt.Println(status.Printer.State, "is an unknown state.")
+		// Capture the first layer more often than the capture interval, to catch its defects early.
+		if shouldLog && inspector != nil && inspector.shouldTrigger(time.Now()) {
+			cam.Trigger()
+		}
 	}
-
-	return false, nil
-}
-
-type Status struct {
-	Job struct {
-		ID            int     `json:"id"`
-		Progress      float64 `json:"progress"`
-		TimeRemaining int     `json:"time_remaining"`
-		TimePrinting  int     `json:"time_printing"`
-	} `json:"job"`
-	Storage struct {
-		Path     string `json:"path"`
-		Name     string `json:"name"`
-		ReadOnly bool   `json:"read_only"`
-	} `json:"storage"`
-	Printer struct {
-		State        string  `json:"state"`
-		TempBed      float64 `json:"temp_bed"`
-		TargetBed    float64 `json:"target_bed"`
-		TempNozzle   float64 `json:"temp_nozzle"`
-		TargetNozzle float64 `json:"target_nozzle"`
-		AxisZ        float64 `json:"axis_z"`
-		Flow         float64 `json:"flow"`
-		Speed        float64 `json:"speed"`
-		FanHotend    float64 `json:"fan_hotend"`
-		FanPrint     float64 `json:"fan_print"`
-	} `json:"printer"`
 }
@@ -0,0 +1,332 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promPrinterState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "printer_state",
+			Help:      "The debounced state of the printer. 1 for the current state, 0 otherwise.",
+		},
+		[]string{"state", "printer"},
+	)
+	promPrinterEvents = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "printer_events_total",
+			Help:      "The number of printer state-transition events emitted.",
+		},
+		[]string{"event", "printer"},
+	)
+	promPrinterPollFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "printer_poll_failures_total",
+			Help:      "The number of failed or unrecognised printer status polls.",
+		},
+		[]string{"printer"},
+	)
+)
+
+type printerState string
+
+// The printer states are the ones reported by PrusaLink, other backends map their states into these.
+// stateUnknown is used until the first state is confirmed and when the printer can't be reached.
+const (
+	stateUnknown   printerState = "UNKNOWN"
+	stateIdle      printerState = "IDLE"
+	stateBusy      printerState = "BUSY"
+	statePrinting  printerState = "PRINTING"
+	statePaused    printerState = "PAUSED"
+	stateFinished  printerState = "FINISHED"
+	stateStopped   printerState = "STOPPED"
+	stateError     printerState = "ERROR"
+	stateAttention printerState = "ATTENTION"
+)
+
+var allPrinterStates = []printerState{stateUnknown, stateIdle, stateBusy, statePrinting, statePaused, stateFinished, stateStopped, stateError, stateAttention}
+
+// parsePrinterState parses a PrusaLink printer state.
+func parsePrinterState(state string) (printerState, bool) {
+	switch state {
+	// Older PrusaLink versions report OPERATIONAL and READY for an idle printer.
+	case "IDLE", "READY", "OPERATIONAL":
+		return stateIdle, true
+	case "BUSY":
+		return stateBusy, true
+	case "PRINTING":
+		return statePrinting, true
+	case "PAUSED":
+		return statePaused, true
+	case "FINISHED":
+		return stateFinished, true
+	case "STOPPED":
+		return stateStopped, true
+	case "ERROR":
+		return stateError, true
+	case "ATTENTION":
+		return stateAttention, true
+	}
+
+	return stateUnknown, false
+}
+
+// isJobActive returns true if there is a job on the printer that hasn't ended yet.
+func (s printerState) isJobActive() bool {
+	return s == statePrinting || s == statePaused || s == stateAttention
+}
+
+type printerEventType string
+
+const (
+	eventJobStarted   printerEventType = "job_started"
+	eventJobPaused    printerEventType = "job_paused"
+	eventJobResumed   printerEventType = "job_resumed"
+	eventJobAttention printerEventType = "job_attention"
+	eventJobFinished  printerEventType = "job_finished"
+	eventJobFailed    printerEventType = "job_failed"
+	// eventStateChanged is emitted for transitions that don't start, change or end a job. Eg, IDLE -> BUSY.
+	eventStateChanged printerEventType = "state_changed"
+)
+
+// printerEvent is a transition between two debounced printer states.
+type printerEvent struct {
+	Type   printerEventType
+	From   printerState
+	To     printerState
+	Status *printerStatus
+	Time   time.Time
+}
+
+// newPrinterEvent returns the event for the transition. previous is the status the from state was confirmed
+// with, nil if the printer was never polled successfully.
+func newPrinterEvent(from, to printerState, previous, status *printerStatus) printerEvent {
+	eventType := eventStateChanged
+	switch to {
+	case statePrinting:
+		switch {
+		case from == statePaused || from == stateAttention:
+			eventType = eventJobResumed
+		case from == stateUnknown && sameJob(previous, status):
+			// The printer was unreachable for a while in the middle of the job, it's not a new one.
+		default:
+			eventType = eventJobStarted
+		}
+	case statePaused:
+		eventType = eventJobPaused
+	case stateAttention:
+		eventType = eventJobAttention
+	case stateFinished:
+		eventType = eventJobFinished
+	case stateStopped, stateError:
+		eventType = eventJobFailed
+	}
+
+	return printerEvent{
+		Type:   eventType,
+		From:   from,
+		To:     to,
+		Status: status,
+		Time:   time.Now(),
+	}
+}
+
+// sameJob returns true if both statuses have the same job.
+func sameJob(previous, status *printerStatus) bool {
+	return previous != nil && status != nil && previous.JobID != "" && previous.JobID == status.JobID
+}
+
+// printerStateTracker turns the raw printer status polls into debounced states. A new state is only
+// confirmed after it was seen in debouncePolls consecutive polls, and the printer only becomes UNKNOWN
+// after unreachablePolls consecutive failed polls. Each confirmed transition is sent to all subscribers.
+type printerStateTracker struct {
+	debouncePolls    int
+	unreachablePolls int
+	log              logger
+
+	mtx         sync.Mutex
+	state       printerState
+	status      *printerStatus
+	candidate   printerState
+	seen        int
+	failedPolls int
+	subscribers []chan printerEvent
+	// stateStatus is the status the state was confirmed with, status moves on with the polls while a new
+	// state is being confirmed. When the printer becomes UNKNOWN it's the last status polled.
+	stateStatus *printerStatus
+
+	// lastPoll is when the last poll finished, successful or not. It starts at the creation of the tracker.
+	lastPoll    time.Time
+	lastPollErr error
+}
+
+func newPrinterStateTracker(debouncePolls, unreachablePolls int, log logger) *printerStateTracker {
+	for _, state := range allPrinterStates {
+		promPrinterState.WithLabelValues(string(state), log.printer).Set(0)
+	}
+	promPrinterState.WithLabelValues(string(stateUnknown), log.printer).Set(1)
+
+	return &printerStateTracker{
+		debouncePolls:    debouncePolls,
+		unreachablePolls: unreachablePolls,
+		log:              log,
+		state:            stateUnknown,
+		lastPoll:         time.Now(),
+	}
+}
+
+// subscribe returns a channel that receives every state transition. The channel is closed by close.
+func (t *printerStateTracker) subscribe() <-chan printerEvent {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	ch := make(chan printerEvent, 16)
+	t.subscribers = append(t.subscribers, ch)
+	return ch
+}
+
+// current returns the confirmed state and the last successfully polled status. The status can be ahead of
+// the state while a new state is being confirmed.
+func (t *printerStateTracker) current() (printerState, *printerStatus) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.state, t.status
+}
+
+// lastPollResult returns when the last poll finished, the number of failed polls in a row and the error of
+// the last poll.
+func (t *printerStateTracker) lastPollResult() (time.Time, int, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	return t.lastPoll, t.failedPolls, t.lastPollErr
+}
+
+// poll fetches the status from the printer every interval until ctx is done.
+func (t *printerStateTracker) poll(ctx context.Context, printer printerBackend, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			status, err := printer.status(ctx)
+			if ctx.Err() != nil {
+				// The poll was cancelled, it says nothing about the printer.
+				return
+			}
+			if err != nil {
+				err = fmt.Errorf("%s: %w", printer.name(), err)
+			}
+			t.observe(ctx, status, err)
+		}
+	}
+}
+
+// observe records the result of a single status poll. Sending the event to the subscribers gives up when
+// ctx is done, so a subscriber that stopped reading doesn't block poll forever.
+func (t *printerStateTracker) observe(ctx context.Context, status *printerStatus, err error) {
+	event, changed := t.update(status, err)
+	if !changed {
+		return
+	}
+
+	t.mtx.Lock()
+	subscribers := t.subscribers
+	t.mtx.Unlock()
+
+	for _, ch := range subscribers {
+		select {
+		case ch <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (t *printerStateTracker) update(status *printerStatus, err error) (printerEvent, bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.lastPoll = time.Now()
+	t.lastPollErr = err
+
+	if err != nil {
+		t.log.Println("failed to poll printer status:", err)
+		promPrinterPollFailures.WithLabelValues(t.log.printer).Inc()
+
+		t.failedPolls++
+		if t.failedPolls == t.unreachablePolls && t.state != stateUnknown {
+			t.log.Printf("printer unreachable for %d polls\n", t.failedPolls)
+			return t.transition(stateUnknown, t.status), true
+		}
+		return printerEvent{}, false
+	}
+	t.failedPolls = 0
+
+	if status.State == stateUnknown {
+		t.log.Println(status.RawState, "is an unknown state. Ignoring it.")
+		promPrinterPollFailures.WithLabelValues(t.log.printer).Inc()
+		return printerEvent{}, false
+	}
+	t.status = status
+
+	state := status.State
+	if state == t.state {
+		t.candidate = ""
+		t.seen = 0
+		return printerEvent{}, false
+	}
+
+	if state != t.candidate {
+		t.candidate = state
+		t.seen = 0
+	}
+	t.seen++
+
+	if t.seen < t.debouncePolls {
+		return printerEvent{}, false
+	}
+	return t.transition(state, status), true
+}
+
+// transition must be called with mtx held.
+func (t *printerStateTracker) transition(to printerState, status *printerStatus) printerEvent {
+	event := newPrinterEvent(t.state, to, t.stateStatus, status)
+	t.log.Printf("printer state changed: %s -> %s (%s)\n", event.From, event.To, event.Type)
+
+	promPrinterState.WithLabelValues(string(t.state), t.log.printer).Set(0)
+	promPrinterState.WithLabelValues(string(to), t.log.printer).Set(1)
+	promPrinterEvents.WithLabelValues(string(event.Type), t.log.printer).Inc()
+
+	t.state = to
+	t.status = status
+	t.stateStatus = status
+	t.candidate = ""
+	t.seen = 0
+
+	return event
+}
+
+// close closes all the subscriber channels. It must not be called while poll is running.
+func (t *printerStateTracker) close() {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, ch := range t.subscribers {
+		close(ch)
+	}
+	t.subscribers = nil
+}
@@ -0,0 +1,114 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// printerRequestTimeout is the timeout of the requests to the printer. A printer that accepts the connection
+// and then hangs mustn't hold up polling, and with it auto-pause, forever.
+const printerRequestTimeout = 10 * time.Second
+
+// printerBackend fetches the status of a printer and controls its jobs. Each backend maps its own API into
+// printerStatus so that capture gating and failure handling work the same for every printer.
+type printerBackend interface {
+	// name is used in logs.
+	name() string
+	status(ctx context.Context) (*printerStatus, error)
+	pauseJob(ctx context.Context, jobID string) error
+}
+
+// printerStatus is the status of the printer and the current job.
+type printerStatus struct {
+	State printerState
+	// RawState is the state as reported by the backend, for logging states that couldn't be mapped.
+	RawState string
+
+	JobID         string
+	JobName       string
+	Progress      float64 // In percent.
+	TimePrinting  time.Duration
+	TimeRemaining time.Duration
+
+	// Not every backend reports the Z height, HasAxisZ is false if AxisZ is unknown.
+	AxisZ    float64
+	HasAxisZ bool
+
+	TempBed      float64
+	TargetBed    float64
+	TempNozzle   float64
+	TargetNozzle float64
+}
+
+type PrinterConfig struct {
+	// The PrusaLink credentials can also be in the userinfo of the URL, but then they show up in ps.
+	PrusaLinkURL          *url.URL `kong:"help='The URL to PrusaLink. When provided we only log images when there is a print job ongoing.',default='',name='prusa-link-url',optional"`
+	PrusaLinkUsername     string   `kong:"help='The username for PrusaLink.',optional,name='prusa-link-username'"`
+	PrusaLinkPassword     string   `kong:"help='The password for PrusaLink.',optional,name='prusa-link-password',env='PRUSALGTM_PRUSA_LINK_PASSWORD'"`
+	PrusaLinkPasswordFile string   `kong:"help='A file with the password for PrusaLink.',optional,name='prusa-link-password-file',type='path'"`
+
+	OctoPrintURL        *url.URL `kong:"help='The URL to OctoPrint. When provided we only log images when there is a print job ongoing.',default='',name='octoprint-url',optional"`
+	OctoPrintAPIKey     string   `kong:"help='The API key for OctoPrint.',optional,name='octoprint-api-key',env='PRUSALGTM_OCTOPRINT_API_KEY'"`
+	OctoPrintAPIKeyFile string   `kong:"help='A file with the API key for OctoPrint.',optional,name='octoprint-api-key-file',type='path'"`
+
+	MoonrakerURL        *url.URL `kong:"help='The URL to Moonraker (Klipper). When provided we only log images when there is a print job ongoing.',default='',name='moonraker-url',optional"`
+	MoonrakerAPIKey     string   `kong:"help='The API key for Moonraker, if it requires one.',optional,name='moonraker-api-key',env='PRUSALGTM_MOONRAKER_API_KEY'"`
+	MoonrakerAPIKeyFile string   `kong:"help='A file with the API key for Moonraker.',optional,name='moonraker-api-key-file',type='path'"`
+
+	PollInterval time.Duration `kong:"help='The interval at which to poll the printer status.',default='5s',name='printer-poll-interval'"`
+	// A single odd poll shouldn't start or stop the camera.
+	DebouncePolls    int `kong:"help='Number of consecutive printer polls that must agree before the printer state changes.',default='2',name='printer-debounce-polls'"`
+	UnreachablePolls int `kong:"help='Number of consecutive failed printer polls before the printer state becomes UNKNOWN.',default='12',name='printer-unreachable-polls'"`
+}
+
+// Validate is called by kong after parsing.
+func (c PrinterConfig) Validate() error {
+	// With less than one poll the printer would never become UNKNOWN.
+	if c.UnreachablePolls < 1 {
+		return fmt.Errorf("--printer-unreachable-polls must be at least 1, got %d", c.UnreachablePolls)
+	}
+	return nil
+}
+
+// newPrinterBackend returns the backend for the configured printer URL, or nil if none is configured.
+func newPrinterBackend(cfg PrinterConfig, log logger) (printerBackend, error) {
+	var backends []printerBackend
+	if isURLSet(cfg.PrusaLinkURL) {
+		password, err := readSecret(cfg.PrusaLinkPassword, cfg.PrusaLinkPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, newPrusaLinkClient(cfg.PrusaLinkURL, cfg.PrusaLinkUsername, password, log))
+	}
+	if isURLSet(cfg.OctoPrintURL) {
+		apiKey, err := readSecret(cfg.OctoPrintAPIKey, cfg.OctoPrintAPIKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, newOctoPrintClient(cfg.OctoPrintURL, apiKey, log))
+	}
+	if isURLSet(cfg.MoonrakerURL) {
+		apiKey, err := readSecret(cfg.MoonrakerAPIKey, cfg.MoonrakerAPIKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, newMoonrakerClient(cfg.MoonrakerURL, apiKey, log))
+	}
+
+	switch len(backends) {
+	case 0:
+		return nil, nil
+	case 1:
+		return backends[0], nil
+	default:
+		return nil, fmt.Errorf("only one of --prusa-link-url, --octoprint-url and --moonraker-url can be set")
+	}
+}
+
+// isURLSet returns false for a URL flag that wasn't set. kong parses the empty default into an empty URL
+// rather than nil.
+func isURLSet(u *url.URL) bool {
+	return u != nil && u.String() != ""
+}
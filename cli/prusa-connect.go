@@ -0,0 +1,276 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/disintegration/imaging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	promPrusaConnectDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prusalgtm",
+			Name:      "prusa_connect_request_duration_seconds",
+			Help:      "A histogram of request latencies to the Prusa Connect camera API.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"code", "method", "printer"},
+	)
+	promPrusaConnectUploads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "prusalgtm",
+			Name:      "prusa_connect_uploads_total",
+			Help:      "The number of snapshot uploads to Prusa Connect by result.",
+		},
+		[]string{"result", "printer", "camera"},
+	)
+	promPrusaConnectUploadSize = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prusalgtm",
+			Name:      "prusa_connect_upload_size_bytes",
+			Help:      "The size of the snapshots uploaded to Prusa Connect.",
+			Buckets:   prometheus.ExponentialBuckets(16*1024, 2, 8),
+		},
+		[]string{"printer", "camera"},
+	)
+)
+
+type PrusaConnectConfig struct {
+	URL       string `kong:"help='The URL of Prusa Connect.',default='https://connect.prusa3d.com',name='prusa-connect-url'"`
+	Token     string `kong:"help='The token of the camera in Prusa Connect. Snapshots are uploaded when it is set.',optional,name='prusa-connect-token',env='PRUSALGTM_PRUSA_CONNECT_TOKEN'"`
+	TokenFile string `kong:"help='A file with the token of the camera in Prusa Connect.',optional,name='prusa-connect-token-file',type='path'"`
+	// Prusa Connect registers the camera under the fingerprint of its first snapshot, so it has to stay the
+	// same across restarts.
+	Fingerprint string        `kong:"help='The fingerprint of the camera in Prusa Connect, 16 to 64 characters. Derived from the hostname, printer and camera if not set.',optional,name='prusa-connect-fingerprint'"`
+	Interval    time.Duration `kong:"help='The interval at which to upload snapshots while the camera is running.',default='10s',name='prusa-connect-interval'"`
+	MaxSize     int           `kong:"help='Maximum size of a snapshot in bytes. Larger frames are scaled down.',default='1000000',name='prusa-connect-max-size'"`
+}
+
+// prusaConnectSink uploads the latest frame of a camera to the camera API of Prusa Connect every interval.
+// The camera only runs while the printer is printing, so the snapshots stop when the camera does.
+type prusaConnectSink struct {
+	url         *url.URL
+	token       string
+	fingerprint string
+	interval    time.Duration
+	maxSize     int
+	client      *http.Client
+	log         logger
+
+	mtx sync.Mutex
+	// frame is the latest frame that wasn't uploaded yet. Only the latest frame is kept, so the backlog is
+	// at most one frame.
+	frame      image.Image
+	lastUpload time.Time
+	lastErr    error
+}
+
+// newPrusaConnectSink returns nil if no token is configured.
+func newPrusaConnectSink(cfg PrusaConnectConfig, log logger) (*prusaConnectSink, error) {
+	token, err := readSecret(cfg.Token, cfg.TokenFile)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, nil
+	}
+
+	connectURL, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --prusa-connect-url: %w", err)
+	}
+
+	fingerprint := cfg.Fingerprint
+	if fingerprint == "" {
+		fingerprint, err = defaultFingerprint(log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(fingerprint) < 16 || len(fingerprint) > 64 {
+		return nil, fmt.Errorf("--prusa-connect-fingerprint must be 16 to 64 characters, got %d", len(fingerprint))
+	}
+
+	durations := promPrusaConnectDuration.MustCurryWith(prometheus.Labels{"printer": log.printer})
+
+	return &prusaConnectSink{
+		url:         connectURL,
+		token:       token,
+		fingerprint: fingerprint,
+		interval:    cfg.Interval,
+		maxSize:     cfg.MaxSize,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: promhttp.InstrumentRoundTripperDuration(durations, http.DefaultTransport),
+		},
+		log: log,
+	}, nil
+}
+
+// defaultFingerprint derives a fingerprint that is stable across restarts from the hostname and the names
+// of the printer and camera.
+func defaultFingerprint(log logger) (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to derive the Prusa Connect fingerprint: %w", err)
+	}
+
+	sum := sha256.Sum256([]byte("prusalgtm/" + hostname + "/" + log.printer + "/" + log.camera))
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// frameHandler returns the frame handler of the camera. It takes frames twice as often as they are
+// uploaded, so there's always a recent one.
+func (s *prusaConnectSink) frameHandler() frameHandler {
+	return frameHandler{handle: s.setFrame, interval: everyInterval(s.interval / 2)}
+}
+
+func (s *prusaConnectSink) setFrame(img image.Image) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.frame = img
+}
+
+// run uploads the latest frame every interval, until ctx is done.
+func (s *prusaConnectSink) run(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mtx.Lock()
+		frame := s.frame
+		s.frame = nil
+		s.mtx.Unlock()
+
+		if frame == nil {
+			continue
+		}
+
+		err := s.upload(ctx, frame)
+		if ctx.Err() != nil {
+			return
+		}
+
+		s.mtx.Lock()
+		first := s.lastUpload.IsZero()
+		s.lastErr = err
+		if err == nil {
+			s.lastUpload = time.Now()
+		}
+		s.mtx.Unlock()
+
+		if err != nil {
+			s.log.Println("failed to upload snapshot to Prusa Connect:", err)
+			continue
+		}
+		if first {
+			s.log.Printf("uploading snapshots to Prusa Connect with fingerprint %s\n", s.fingerprint)
+		}
+	}
+}
+
+func (s *prusaConnectSink) upload(ctx context.Context, frame image.Image) error {
+	snapshot, err := s.encode(frame)
+	if err != nil {
+		promPrusaConnectUploads.WithLabelValues("too_large", s.log.printer, s.log.camera).Inc()
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.url.JoinPath("/c/snapshot").String(), bytes.NewReader(snapshot))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "image/jpg")
+	req.Header.Set("Token", s.token)
+	req.Header.Set("Fingerprint", s.fingerprint)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		promPrusaConnectUploads.WithLabelValues("failed", s.log.printer, s.log.camera).Inc()
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		promPrusaConnectUploads.WithLabelValues("failed", s.log.printer, s.log.camera).Inc()
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	promPrusaConnectUploads.WithLabelValues("uploaded", s.log.printer, s.log.camera).Inc()
+	promPrusaConnectUploadSize.WithLabelValues(s.log.printer, s.log.camera).Observe(float64(len(snapshot)))
+	return nil
+}
+
+// encode encodes the frame as a JPEG, scaling it down until it fits in maxSize.
+func (s *prusaConnectSink) encode(frame image.Image) ([]byte, error) {
+	for _, size := range validImageSizes {
+		img := frame
+		if frame.Bounds().Dy() > int(size) {
+			img = imaging.Resize(frame, 0, int(size), imaging.Lanczos)
+		} else if size != validImageSizes[0] {
+			// Smaller than the size, and it didn't fit at a bigger size either.
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		if err := jpeg.Encode(buf, img, nil); err != nil {
+			return nil, err
+		}
+		if buf.Len() <= s.maxSize {
+			return buf.Bytes(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("the snapshot doesn't fit in %d bytes even at %dp", s.maxSize, validImageSizes[len(validImageSizes)-1])
+}
+
+func (s *prusaConnectSink) healthCheck() healthCheck {
+	return func() componentHealth {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		backlog := 0
+		if s.frame != nil {
+			backlog = 1
+		}
+
+		health := componentHealth{
+			Component: "prusa-connect",
+			Printer:   s.log.printer,
+			Camera:    s.log.camera,
+			Healthy:   true,
+			Ready:     s.lastErr == nil,
+			Details:   map[string]any{"backlog": backlog, "backlog_size": 1},
+		}
+		if !s.lastUpload.IsZero() {
+			health.Details["last_upload"] = s.lastUpload
+		}
+		if s.lastErr != nil {
+			health.Message = "the last snapshot upload failed"
+			health.Details["last_error"] = s.lastErr.Error()
+		}
+
+		return health
+	}
+}
@@ -0,0 +1,208 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeConnect is a stand-in for the camera API of Prusa Connect that records the snapshots.
+type fakeConnect struct {
+	status int
+
+	mtx      sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newFakeConnect(t *testing.T, status int) (*fakeConnect, *httptest.Server) {
+	f := &fakeConnect{status: status}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		f.mtx.Lock()
+		f.requests = append(f.requests, r)
+		f.bodies = append(f.bodies, body)
+		f.mtx.Unlock()
+
+		w.WriteHeader(f.status)
+	}))
+	t.Cleanup(srv.Close)
+
+	return f, srv
+}
+
+func (f *fakeConnect) uploads() int {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	return len(f.requests)
+}
+
+func newTestSink(t *testing.T, connectURL string, maxSize int) *prusaConnectSink {
+	t.Helper()
+
+	sink, err := newPrusaConnectSink(PrusaConnectConfig{
+		URL:         connectURL,
+		Token:       "camera-token",
+		Fingerprint: "0123456789abcdef",
+		Interval:    10 * time.Millisecond,
+		MaxSize:     maxSize,
+	}, newLogger("test", t.Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sink
+}
+
+// noiseFrame returns a frame that doesn't compress well, like a real camera frame.
+func noiseFrame(width, height int) image.Image {
+	rnd := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255})
+		}
+	}
+	return img
+}
+
+func TestPrusaConnectUpload(t *testing.T) {
+	connect, srv := newFakeConnect(t, http.StatusNoContent)
+	sink := newTestSink(t, srv.URL, 1000000)
+
+	if err := sink.upload(context.Background(), noiseFrame(640, 480)); err != nil {
+		t.Fatal(err)
+	}
+
+	if connect.uploads() != 1 {
+		t.Fatalf("expected 1 upload, got %d", connect.uploads())
+	}
+	req := connect.requests[0]
+	if req.Method != http.MethodPut || req.URL.Path != "/c/snapshot" {
+		t.Errorf("expected PUT /c/snapshot, got %s %s", req.Method, req.URL.Path)
+	}
+	if got := req.Header.Get("Token"); got != "camera-token" {
+		t.Errorf("expected the Token header to be the token, got %q", got)
+	}
+	if got := req.Header.Get("Fingerprint"); got != "0123456789abcdef" {
+		t.Errorf("expected the Fingerprint header to be the fingerprint, got %q", got)
+	}
+	if got := req.Header.Get("Content-Type"); got != "image/jpg" {
+		t.Errorf("expected an image/jpg snapshot, got %q", got)
+	}
+	if _, err := jpeg.Decode(bytes.NewReader(connect.bodies[0])); err != nil {
+		t.Errorf("the snapshot isn't a JPEG: %v", err)
+	}
+
+	if got := testutil.ToFloat64(promPrusaConnectUploads.WithLabelValues("uploaded", "test", t.Name())); got != 1 {
+		t.Errorf("expected 1 uploaded snapshot in the metrics, got %v", got)
+	}
+}
+
+func TestPrusaConnectScalesDownLargeFrames(t *testing.T) {
+	connect, srv := newFakeConnect(t, http.StatusNoContent)
+	const maxSize = 100000
+	sink := newTestSink(t, srv.URL, maxSize)
+
+	if err := sink.upload(context.Background(), noiseFrame(1920, 1080)); err != nil {
+		t.Fatal(err)
+	}
+
+	body := connect.bodies[0]
+	if len(body) > maxSize {
+		t.Errorf("expected the snapshot to fit in %d bytes, got %d", maxSize, len(body))
+	}
+	img, err := jpeg.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dy() >= 1080 {
+		t.Errorf("expected the snapshot to be scaled down, got %dp", img.Bounds().Dy())
+	}
+}
+
+func TestPrusaConnectTooLargeFrame(t *testing.T) {
+	connect, srv := newFakeConnect(t, http.StatusNoContent)
+	sink := newTestSink(t, srv.URL, 100)
+
+	if err := sink.upload(context.Background(), noiseFrame(640, 480)); err == nil {
+		t.Fatal("expected an error for a frame that doesn't fit at any size")
+	}
+	if connect.uploads() != 0 {
+		t.Errorf("expected no uploads, got %d", connect.uploads())
+	}
+	if got := testutil.ToFloat64(promPrusaConnectUploads.WithLabelValues("too_large", "test", t.Name())); got != 1 {
+		t.Errorf("expected 1 too large snapshot in the metrics, got %v", got)
+	}
+}
+
+func TestPrusaConnectFailedUpload(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusInternalServerError} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			_, srv := newFakeConnect(t, status)
+			sink := newTestSink(t, srv.URL, 1000000)
+
+			if err := sink.upload(context.Background(), noiseFrame(640, 480)); err == nil {
+				t.Fatalf("expected an error for a %d response", status)
+			}
+			if got := testutil.ToFloat64(promPrusaConnectUploads.WithLabelValues("failed", "test", t.Name())); got != 1 {
+				t.Errorf("expected 1 failed upload in the metrics, got %v", got)
+			}
+			if got := testutil.ToFloat64(promPrusaConnectUploads.WithLabelValues("uploaded", "test", t.Name())); got != 0 {
+				t.Errorf("expected no uploaded snapshots in the metrics, got %v", got)
+			}
+		})
+	}
+}
+
+// The camera only runs while printing, so the frames stop when the print does. The sink must upload
+// nothing without a new frame, and not upload the last frame again.
+func TestPrusaConnectOnlyUploadsNewFrames(t *testing.T) {
+	connect, srv := newFakeConnect(t, http.StatusNoContent)
+	sink := newTestSink(t, srv.URL, 1000000)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sink.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	if connect.uploads() != 0 {
+		t.Fatalf("expected no uploads before the camera runs, got %d", connect.uploads())
+	}
+
+	sink.setFrame(noiseFrame(640, 480))
+	deadline := time.Now().Add(5 * time.Second)
+	for connect.uploads() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if connect.uploads() != 1 {
+		t.Fatalf("expected the frame to be uploaded, got %d uploads", connect.uploads())
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if connect.uploads() != 1 {
+		t.Errorf("expected the frame to be uploaded once after the camera stopped, got %d uploads", connect.uploads())
+	}
+	if health := sink.healthCheck()(); !health.Ready {
+		t.Errorf("expected the sink to be ready after a successful upload, got %+v", health)
+	}
+}
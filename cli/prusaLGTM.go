@@ -1,9 +1,15 @@
 package cli
 
-var PrusaLGTM struct {
+import "github.com/alecthomas/kong"
+
+type prusaLGTM struct {
 	PrintImage        printImage               `cmd:"print-image" help:"Print images from a camera to stdout."`
 	FailureDetect     failureDetectCommand     `cmd:"failure-detect" help:"Detect failures in the print images."`
 	GenerateTimelapse generateTimelapseCommand `cmd:"generate-timelapse" help:"Generate a timelapse video from the print images."`
+	Farm              farmCommand              `cmd:"farm" help:"Print images from all the printers in the config file."`
 
-	PrometheusPort int `kong:"help='The port to expose Prometheus metrics on.',default='8366',name='prometheus-port'"`
+	ConfigFile     kong.ConfigFlag `kong:"help='A YAML file with the values of the flags. Flags on the command line override it.',optional,name='config-file'"`
+	PrometheusPort int             `kong:"help='The port to expose Prometheus metrics on.',default='8366',name='prometheus-port'"`
 }
+
+var PrusaLGTM prusaLGTM
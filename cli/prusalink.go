@@ -0,0 +1,198 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/icholy/digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	promPrusaLinkDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "prusalgtm",
+			Name:      "prusalink_request_duration_seconds",
+			Help:      "A histogram of request latencies to the PrusaLink API.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"code", "method", "printer"},
+	)
+)
+
+// prusaLinkClient talks to the PrusaLink API using HTTP digest auth. If no username is given, the
+// credentials are taken from the userinfo of the URL.
+type prusaLinkClient struct {
+	url    *url.URL
+	client *http.Client
+	log    logger
+
+	// The status doesn't have the file name, so it's fetched once per job.
+	jobMtx  sync.Mutex
+	jobID   int
+	jobName string
+}
+
+func newPrusaLinkClient(prusaLinkURL *url.URL, username, password string, log logger) *prusaLinkClient {
+	if username == "" {
+		username = prusaLinkURL.User.Username()
+		password, _ = prusaLinkURL.User.Password()
+	}
+
+	client := &http.Client{
+		Timeout: printerRequestTimeout,
+		Transport: &digest.Transport{
+			Username: username,
+			Password: password,
+		},
+	}
+	client.Transport = promhttp.InstrumentRoundTripperDuration(promPrusaLinkDuration.MustCurryWith(prometheus.Labels{"printer": log.printer}), client.Transport)
+
+	apiURL := *prusaLinkURL
+	apiURL.User = nil
+
+	return &prusaLinkClient{
+		url:    &apiURL,
+		client: client,
+		log:    log,
+	}
+}
+
+func (p *prusaLinkClient) name() string {
+	return "PrusaLink"
+}
+
+func (p *prusaLinkClient) status(ctx context.Context) (*printerStatus, error) {
+	var status prusaLinkStatus
+	if err := p.get(ctx, "/api/v1/status", &status); err != nil {
+		return nil, err
+	}
+
+	state, _ := parsePrinterState(status.Printer.State)
+	printerStatus := &printerStatus{
+		State:         state,
+		RawState:      status.Printer.State,
+		Progress:      status.Job.Progress,
+		TimePrinting:  time.Duration(status.Job.TimePrinting) * time.Second,
+		TimeRemaining: time.Duration(status.Job.TimeRemaining) * time.Second,
+		AxisZ:         status.Printer.AxisZ,
+		HasAxisZ:      true,
+		TempBed:       status.Printer.TempBed,
+		TargetBed:     status.Printer.TargetBed,
+		TempNozzle:    status.Printer.TempNozzle,
+		TargetNozzle:  status.Printer.TargetNozzle,
+	}
+
+	if status.Job.ID != 0 {
+		printerStatus.JobID = strconv.Itoa(status.Job.ID)
+		printerStatus.JobName = p.fetchJobName(ctx, status.Job.ID)
+	}
+
+	return printerStatus, nil
+}
+
+func (p *prusaLinkClient) fetchJobName(ctx context.Context, jobID int) string {
+	p.jobMtx.Lock()
+	defer p.jobMtx.Unlock()
+
+	if jobID == p.jobID {
+		return p.jobName
+	}
+
+	var job prusaLinkJob
+	if err := p.get(ctx, "/api/v1/job", &job); err != nil {
+		p.log.Println("failed to fetch PrusaLink job:", err)
+		return ""
+	}
+	if job.ID != jobID {
+		return ""
+	}
+
+	p.jobID = jobID
+	p.jobName = job.File.DisplayName
+	if p.jobName == "" {
+		p.jobName = job.File.Name
+	}
+
+	return p.jobName
+}
+
+func (p *prusaLinkClient) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url.JoinPath(path).String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch PrusaLink %s. status: %s", path, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (p *prusaLinkClient) pauseJob(ctx context.Context, jobID string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, p.url.JoinPath("/api/v1/job", jobID, "pause").String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to pause job %s. status: %s", jobID, resp.Status)
+	}
+
+	return nil
+}
+
+type prusaLinkJob struct {
+	ID   int `json:"id"`
+	File struct {
+		Name        string `json:"name"`
+		DisplayName string `json:"display_name"`
+	} `json:"file"`
+}
+
+type prusaLinkStatus struct {
+	Job struct {
+		ID            int     `json:"id"`
+		Progress      float64 `json:"progress"`
+		TimeRemaining int     `json:"time_remaining"`
+		TimePrinting  int     `json:"time_printing"`
+	} `json:"job"`
+	Storage struct {
+		Path     string `json:"path"`
+		Name     string `json:"name"`
+		ReadOnly bool   `json:"read_only"`
+	} `json:"storage"`
+	Printer struct {
+		State        string  `json:"state"`
+		TempBed      float64 `json:"temp_bed"`
+		TargetBed    float64 `json:"target_bed"`
+		TempNozzle   float64 `json:"temp_nozzle"`
+		TargetNozzle float64 `json:"target_nozzle"`
+		AxisZ        float64 `json:"axis_z"`
+		Flow         float64 `json:"flow"`
+		Speed        float64 `json:"speed"`
+		FanHotend    float64 `json:"fan_hotend"`
+		FanPrint     float64 `json:"fan_print"`
+	} `json:"printer"`
+}
@@ -0,0 +1,74 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// liveSettings are the print-image settings that are applied on SIGHUP without restarting capture. The
+// camera, the printer and the ML API need a restart to change.
+type liveSettings struct {
+	MaxLogSize    int
+	MaxImageSize  ImageSize
+	AutoPause     AutoPauseConfig
+	CapturePolicy CapturePolicyConfig
+}
+
+func (p *printImage) liveSettings() liveSettings {
+	return liveSettings{
+		MaxLogSize:    p.MaxLogSize,
+		MaxImageSize:  p.MaxImageSize,
+		AutoPause:     p.AutoPauseConfig,
+		CapturePolicy: p.CapturePolicyConfig,
+	}
+}
+
+// liveConfig holds the live settings, which can be read while they are being reloaded.
+type liveConfig struct {
+	mtx      sync.Mutex
+	settings liveSettings
+}
+
+func newLiveConfig(settings liveSettings) *liveConfig {
+	return &liveConfig{settings: settings}
+}
+
+func (l *liveConfig) get() liveSettings {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.settings
+}
+
+func (l *liveConfig) set(settings liveSettings) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.settings = settings
+}
+
+// reloadOnSIGHUP calls reload every time the process gets a SIGHUP, until ctx is done. reload is expected
+// to read the config file again and apply the live settings.
+func reloadOnSIGHUP(ctx context.Context, reload func() error) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			if err := reload(); err != nil {
+				fmt.Println("failed to reload config:", err)
+				continue
+			}
+
+			fmt.Println("config reloaded from", PrusaLGTM.ConfigFile)
+		}
+	}
+}
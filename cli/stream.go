@@ -0,0 +1,228 @@
+package cli
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	promStreamClients = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "prusalgtm",
+			Name:      "stream_clients",
+			Help:      "The number of clients watching the MJPEG stream.",
+		},
+		[]string{"printer", "camera"},
+	)
+)
+
+type StreamConfig struct {
+	Enabled bool `kong:"help='Serve /snapshot.jpg and /stream.mjpg of the camera on the Prometheus port.',default='false',name='stream'"`
+	// The camera can see more than the printer, so it shouldn't be open to the whole network by default.
+	Username     string `kong:"help='The username for basic auth on the stream endpoints.',optional,name='stream-username'"`
+	Password     string `kong:"help='The password for basic auth on the stream endpoints.',optional,name='stream-password',env='PRUSALGTM_STREAM_PASSWORD'"`
+	PasswordFile string `kong:"help='A file with the password for basic auth on the stream endpoints.',optional,name='stream-password-file',type='path'"`
+}
+
+// liveFrame is a frame that is encoded to JPEG the first time it's requested, and only once no matter
+// how many clients are watching. A frame with draw set is only drawn then too.
+type liveFrame struct {
+	img  image.Image
+	draw func() image.Image
+
+	once sync.Once
+	jpeg []byte
+	err  error
+}
+
+func (f *liveFrame) encode() ([]byte, error) {
+	f.once.Do(func() {
+		if f.img == nil {
+			f.img = f.draw()
+		}
+		buf := new(bytes.Buffer)
+		f.err = jpeg.Encode(buf, f.img, nil)
+		f.jpeg = buf.Bytes()
+	})
+
+	return f.jpeg, f.err
+}
+
+// liveViewIdleInterval is how often the snapshot is updated while nobody watches the stream. The stream
+// gets every frame of the camera.
+const liveViewIdleInterval = 5 * time.Second
+
+// liveView keeps the latest frame of a camera, and the latest frame with the detection overlays, for the
+// snapshot and stream endpoints.
+type liveView struct {
+	log logger
+	// streams is the number of clients watching the stream of the frames.
+	streams atomic.Int32
+
+	mtx       sync.Mutex
+	frame     *liveFrame
+	annotated *liveFrame
+	// updated and annotatedUpdated are closed and replaced on every new frame, to wake up the streams.
+	updated          chan struct{}
+	annotatedUpdated chan struct{}
+}
+
+func newLiveView(log logger) *liveView {
+	return &liveView{
+		log:              log,
+		updated:          make(chan struct{}),
+		annotatedUpdated: make(chan struct{}),
+	}
+}
+
+// frameHandler returns the frame handler of the camera.
+func (v *liveView) frameHandler() frameHandler {
+	return frameHandler{handle: v.setFrame, interval: func() time.Duration {
+		if v.streams.Load() > 0 {
+			return 0
+		}
+		return liveViewIdleInterval
+	}}
+}
+
+func (v *liveView) setFrame(img image.Image) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	v.frame = &liveFrame{img: img}
+	close(v.updated)
+	v.updated = make(chan struct{})
+}
+
+// setAnnotated records a frame that went through the detector. draw draws the detection overlays on it,
+// which is only done if a client asks for the frame.
+func (v *liveView) setAnnotated(draw func() image.Image) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	v.annotated = &liveFrame{draw: draw}
+	close(v.annotatedUpdated)
+	v.annotatedUpdated = make(chan struct{})
+}
+
+func (v *liveView) latest(annotated bool) (*liveFrame, <-chan struct{}) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	if annotated {
+		return v.annotated, v.annotatedUpdated
+	}
+	return v.frame, v.updated
+}
+
+// register adds the endpoints of the view to mux, under prefix.
+func (v *liveView) register(mux *http.ServeMux, prefix string, username, password string) {
+	mux.Handle(prefix+"/snapshot.jpg", basicAuth(username, password, http.HandlerFunc(v.serveSnapshot)))
+	mux.Handle(prefix+"/stream.mjpg", basicAuth(username, password, http.HandlerFunc(v.serveStream)))
+}
+
+// serveSnapshot serves the latest frame. With ?overlays=true it serves the latest frame that went through
+// the detector instead, with the detected failures drawn on it.
+func (v *liveView) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	overlays, _ := strconv.ParseBool(r.URL.Query().Get("overlays"))
+	frame, _ := v.latest(overlays)
+	if frame == nil {
+		http.Error(w, "no frame yet, the camera only runs while printing", http.StatusServiceUnavailable)
+		return
+	}
+
+	img, err := frame.encode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(img)
+}
+
+const streamBoundary = "prusalgtmframe"
+
+// serveStream serves the frames as a multipart MJPEG stream, as they are read from the camera. With
+// ?overlays=true it serves the frames with the detected failures drawn on them instead, as the detector
+// gets through them.
+func (v *liveView) serveStream(w http.ResponseWriter, r *http.Request) {
+	overlays, _ := strconv.ParseBool(r.URL.Query().Get("overlays"))
+
+	promStreamClients.WithLabelValues(v.log.printer, v.log.camera).Inc()
+	defer promStreamClients.WithLabelValues(v.log.printer, v.log.camera).Dec()
+	if !overlays {
+		v.streams.Add(1)
+		defer v.streams.Add(-1)
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+streamBoundary)
+	w.Header().Set("Cache-Control", "no-store")
+	flusher, _ := w.(http.Flusher)
+
+	frame, updated := v.latest(overlays)
+	for {
+		if frame != nil {
+			img, err := frame.encode()
+			if err != nil {
+				v.log.Println("failed to encode stream frame:", err)
+				return
+			}
+
+			_, err = fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", streamBoundary, len(img))
+			if err == nil {
+				_, err = w.Write(img)
+			}
+			if err == nil {
+				_, err = io.WriteString(w, "\r\n")
+			}
+			if err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-updated:
+		}
+		frame, updated = v.latest(overlays)
+	}
+}
+
+// basicAuth requires the username and password on every request to next. Without a username there is no
+// auth.
+func basicAuth(username, password string, next http.Handler) http.Handler {
+	if username == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="prusaLGTM"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -6,11 +6,14 @@ require (
 	github.com/alecthomas/kong v0.9.0
 	github.com/blackjack/webcam v0.6.1
 	github.com/disintegration/imaging v1.6.2
+	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/fogleman/gg v1.3.0
 	github.com/grafana/loki v1.6.1
 	github.com/icholy/digest v0.1.23
 	github.com/icza/mjpeg v0.0.0-20230330134156-38318e5ab8f4
 	github.com/prometheus/client_golang v1.19.1
+	golang.org/x/image v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
@@ -31,6 +34,7 @@ require (
 	github.com/golang/protobuf v1.5.3 // indirect
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/gorilla/mux v1.7.3 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/grpc-ecosystem/go-grpc-middleware v1.1.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
@@ -55,7 +59,6 @@ require (
 	github.com/weaveworks/promrus v1.2.0 // indirect
 	go.uber.org/atomic v1.6.0 // indirect
 	go.uber.org/goleak v1.0.0 // indirect
-	golang.org/x/image v0.17.0 // indirect
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
 	golang.org/x/net v0.25.0 // indirect
 	golang.org/x/sync v0.7.0 // indirect
@@ -65,5 +68,4 @@ require (
 	google.golang.org/genproto v0.0.0-20200724131911-43cab4749ae7 // indirect
 	google.golang.org/grpc v1.30.0 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
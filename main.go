@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/alecthomas/kong"
 	"github.com/gouthamve/prusaLGTM/cli"
@@ -10,16 +14,31 @@ import (
 )
 
 func main() {
-	ctx := kong.Parse(&cli.PrusaLGTM, kong.Name("prusaLGTM"),
+	// The commands stop cleanly when the context is cancelled: cameras are stopped and timelapses finalised.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		fmt.Println("shutting down, interrupt again to exit immediately")
+		stop()
+	}()
+
+	kctx := kong.Parse(&cli.PrusaLGTM, kong.Name("prusaLGTM"),
 		kong.Description("Monitor Prusa using Loki and Prometheus to make sure it is looking good."),
 		kong.UsageOnError(),
+		kong.Configuration(cli.ConfigLoader),
+		kong.BindTo(ctx, (*context.Context)(nil)),
 		kong.ConfigureHelp(kong.HelpOptions{
 			Compact: true,
 			Summary: true,
 		}))
 
 	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", cli.HealthzHandler())
+	http.Handle("/readyz", cli.ReadyzHandler())
+	http.Handle("/ml-api/frames/", cli.MLAPIFramesHandler())
 	go http.ListenAndServe(fmt.Sprintf(":%d", cli.PrusaLGTM.PrometheusPort), nil)
+	go cli.NotifySystemdWatchdog(ctx)
 
-	ctx.FatalIfErrorf(ctx.Run())
+	kctx.FatalIfErrorf(kctx.Run())
 }